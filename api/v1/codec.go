@@ -0,0 +1,124 @@
+package log_v1
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+)
+
+// MaxBatchBytes is the most a batch can decompress to. Batches come from clients, so without a limit a small batch could decompress to more memory than the server has.
+// It's well above the 4MiB gRPC messages the server accepts, so it never gets in the way of the batches the log writes itself.
+const MaxBatchBytes = 32 << 20
+
+var errBatchTooLarge = fmt.Errorf("batch decompresses to more than %d bytes", MaxBatchBytes)
+
+// The zstd encoder and decoder are safe to share, and expensive enough to create that we only want one of each.
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) { return zstd.NewWriter(nil) })
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxBatchBytes))
+	})
+)
+
+// Compress compresses the bytes with the codec.
+func (c Codec) Compress(p []byte) ([]byte, error) {
+	switch c {
+	case Codec_CODEC_NONE:
+		return p, nil
+	case Codec_CODEC_GZIP:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(p); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Codec_CODEC_SNAPPY:
+		return snappy.Encode(nil, p), nil
+	case Codec_CODEC_ZSTD:
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(p, nil), nil
+	}
+	return nil, fmt.Errorf("unknown codec %d", c)
+}
+
+// Decompress reverses Compress. It fails if the bytes decompress to more than MaxBatchBytes.
+func (c Codec) Decompress(p []byte) ([]byte, error) {
+	switch c {
+	case Codec_CODEC_NONE:
+		return p, nil
+	case Codec_CODEC_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		// We read one byte past the limit, so we can tell a batch that's exactly at it from one that's over it.
+		out, err := io.ReadAll(io.LimitReader(r, MaxBatchBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > MaxBatchBytes {
+			return nil, errBatchTooLarge
+		}
+		return out, nil
+	case Codec_CODEC_SNAPPY:
+		// Snappy says how long the decompressed bytes are up front, so we check that before allocating them.
+		n, err := snappy.DecodedLen(p)
+		if err != nil {
+			return nil, err
+		}
+		if n > MaxBatchBytes {
+			return nil, errBatchTooLarge
+		}
+		return snappy.Decode(nil, p)
+	case Codec_CODEC_ZSTD:
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		out, err := dec.DecodeAll(p, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) || len(out) > MaxBatchBytes {
+			return nil, errBatchTooLarge
+		}
+		return out, err
+	}
+	return nil, fmt.Errorf("unknown codec %d", c)
+}
+
+// NewRecordBatch compresses the records into a batch with the codec.
+func NewRecordBatch(codec Codec, records []*Record) (*RecordBatch, error) {
+	p, err := proto.Marshal(&Records{Records: records})
+	if err != nil {
+		return nil, err
+	}
+	if p, err = codec.Compress(p); err != nil {
+		return nil, ErrInvalidBatch{Err: err}
+	}
+	return &RecordBatch{Codec: codec, Records: p}, nil
+}
+
+// Decode decompresses the batch's records.
+func (b *RecordBatch) Decode() ([]*Record, error) {
+	p, err := b.Codec.Decompress(b.Records)
+	if err != nil {
+		return nil, ErrInvalidBatch{Err: err}
+	}
+	records := &Records{}
+	if err = proto.Unmarshal(p, records); err != nil {
+		return nil, ErrInvalidBatch{Err: err}
+	}
+	return records.Records, nil
+}
@@ -2,6 +2,7 @@ package log_v1
 
 import (
 	"fmt"
+	"strconv"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	codes "google.golang.org/grpc/codes"
@@ -29,3 +30,183 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+type ErrInvalidTopic struct {
+	Topic string
+}
+
+func (e ErrInvalidTopic) GRPCStatus() *status.Status {
+	return status.New(codes.InvalidArgument, fmt.Sprintf("invalid topic name %q", e.Topic))
+}
+
+func (e ErrInvalidTopic) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrInvalidPartition struct {
+	Topic     string
+	Partition uint32
+}
+
+func (e ErrInvalidPartition) GRPCStatus() *status.Status {
+	return status.New(codes.InvalidArgument, fmt.Sprintf("partition %d not found in topic %q", e.Partition, e.Topic))
+}
+
+func (e ErrInvalidPartition) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrUnknownMember struct {
+	Group  string
+	Member string
+}
+
+func (e ErrUnknownMember) GRPCStatus() *status.Status {
+	return status.New(codes.NotFound, fmt.Sprintf("member %q is not part of group %q, it needs to rejoin", e.Member, e.Group))
+}
+
+func (e ErrUnknownMember) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrStaleGeneration struct {
+	Group      string
+	Member     string
+	Generation uint64
+}
+
+func (e ErrStaleGeneration) GRPCStatus() *status.Status {
+	return status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("member %q of group %q is on stale generation %d, it needs to sync its new assignment", e.Member, e.Group, e.Generation),
+	)
+}
+
+func (e ErrStaleGeneration) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrInvalidBatch struct {
+	Err error
+}
+
+func (e ErrInvalidBatch) GRPCStatus() *status.Status {
+	return status.New(codes.InvalidArgument, fmt.Sprintf("invalid record batch: %v", e.Err))
+}
+
+func (e ErrInvalidBatch) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+func (e ErrInvalidBatch) Unwrap() error {
+	return e.Err
+}
+
+type ErrCorruptRecord struct {
+	Offset   uint64
+	Position uint64
+	Reason   string
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	return status.New(codes.DataLoss, fmt.Sprintf("record %d at position %d is corrupt: %s", e.Offset, e.Position, e.Reason))
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrSequenceOutOfOrder struct {
+	ProducerID uint64
+	Sequence   uint64
+	Last       uint64
+}
+
+func (e ErrSequenceOutOfOrder) GRPCStatus() *status.Status {
+	if e.Sequence > e.Last {
+		return status.New(
+			codes.FailedPrecondition,
+			fmt.Sprintf("sequence %d of producer %d skips ahead of its next sequence %d", e.Sequence, e.ProducerID, e.Last+1),
+		)
+	}
+	return status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("sequence %d of producer %d is before its last sequence %d and doesn't match a recent record", e.Sequence, e.ProducerID, e.Last),
+	)
+}
+
+func (e ErrSequenceOutOfOrder) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrOffsetMismatch struct {
+	Expected uint64
+	Actual   uint64
+}
+
+func (e ErrOffsetMismatch) GRPCStatus() *status.Status {
+	status := status.New(
+		codes.FailedPrecondition,
+		fmt.Sprintf("expected the next offset to be %d, but it's %d", e.Expected, e.Actual),
+	)
+	// The actual next offset is in the details too, so clients can retry with it without parsing the message.
+	d := &errdetails.ErrorInfo{
+		Reason: "OFFSET_MISMATCH",
+		Domain: "proglog",
+		Metadata: map[string]string{
+			"expected_offset": strconv.FormatUint(e.Expected, 10),
+			"next_offset":     strconv.FormatUint(e.Actual, 10),
+		},
+	}
+	std, err := status.WithDetails(d)
+	if err != nil {
+		return status
+	}
+	return std
+}
+
+func (e ErrOffsetMismatch) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrNotLeader struct {
+	// Leader is the address of the leader, or empty if there isn't one.
+	Leader string
+}
+
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	msg := "named topics are only kept on the leader, and there is no leader"
+	if e.Leader != "" {
+		msg = fmt.Sprintf("named topics are only kept on the leader at %s", e.Leader)
+	}
+	status := status.New(codes.FailedPrecondition, msg)
+	// The leader is in the details too, so clients can retry there without parsing the message.
+	d := &errdetails.ErrorInfo{
+		Reason: "NOT_LEADER",
+		Domain: "proglog",
+		Metadata: map[string]string{
+			"leader": e.Leader,
+		},
+	}
+	std, err := status.WithDetails(d)
+	if err != nil {
+		return status
+	}
+	return std
+}
+
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrUnknownTransaction struct {
+	ID uint64
+}
+
+func (e ErrUnknownTransaction) GRPCStatus() *status.Status {
+	return status.New(codes.FailedPrecondition, fmt.Sprintf("transaction %d is not open", e.ID))
+}
+
+func (e ErrUnknownTransaction) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
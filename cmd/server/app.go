@@ -1,25 +1,21 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"os"
 	"time"
 
-	"github.com/MartinMinkov/proglog/internal/auth"
+	"github.com/MartinMinkov/proglog/internal/agent"
 	"github.com/MartinMinkov/proglog/internal/config"
 	"github.com/MartinMinkov/proglog/internal/log"
-	"github.com/MartinMinkov/proglog/internal/server"
 	"go.opencensus.io/examples/exporter"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
 )
 
-type GRPCServerResult struct {
-	Server  *grpc.Server
-	Log     *log.Log
+type AgentResult struct {
+	Agent   *agent.Agent
 	Cleanup func()
-	Start   func()
 }
 
 func setupTelemetryServer() (*exporter.LogExporter, error) {
@@ -54,48 +50,82 @@ func setupTelemetryServer() (*exporter.LogExporter, error) {
 	return telemetryExporter, nil
 }
 
-func setupTLSServerConfig(serverAddress string) (credentials.TransportCredentials, error) {
-	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+func setupTLSPeerConfig(serverAddress string) (*tls.Config, error) {
+	return config.SetupTLSConfig(config.TLSConfig{
 		ServerAddress: serverAddress,
-		CertFile:      config.ServerCertFile,
-		KeyFile:       config.ServerKeyFile,
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
 		CAFile:        config.CAFile,
-		Server:        true,
+		Server:        false,
 	})
-	if err != nil {
-		return nil, err
+}
+
+type AppConfig struct {
+	DataDir        string
+	NodeName       string
+	BindAddr       string
+	RPCPort        int
+	StartJoinAddrs []string
+	Bootstrap      bool
+	Durability     log.Durability
+}
+
+// parseSync parses the -sync flag, which is never, always, or how often to fsync, e.g. 1s.
+func parseSync(s string) (log.Durability, error) {
+	switch s {
+	case "", "never":
+		return log.Durability{Sync: log.SyncNever}, nil
+	case "always":
+		return log.Durability{Sync: log.SyncAlways}, nil
 	}
-	return credentials.NewTLS(serverTLSConfig), nil
+	interval, err := time.ParseDuration(s)
+	if err != nil || interval <= 0 {
+		return log.Durability{}, fmt.Errorf("invalid sync policy %q, expected never, always or an interval", s)
+	}
+	return log.Durability{Sync: log.SyncInterval, Interval: interval}, nil
 }
 
-func SetupGRPCServer() (*GRPCServerResult, error) {
-	// TODO: Make listener configurable
-	listener, err := net.Listen("tcp", "127.0.0.1:8080")
-	if err != nil {
-		return nil, err
+func SetupAgent(c AppConfig) (*AgentResult, error) {
+	dataDir := c.DataDir
+	if dataDir == "" {
+		var err error
+		if dataDir, err = os.MkdirTemp(os.TempDir(), "proglog"); err != nil {
+			return nil, err
+		}
 	}
 
-	dir, err := os.MkdirTemp(os.TempDir(), "proglog")
+	host, _, err := net.SplitHostPort(c.BindAddr)
 	if err != nil {
 		return nil, err
 	}
-
-	clog, err := log.NewLog(dir, log.Config{})
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		ServerAddress: host,
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
-	config := &server.Config{
-		CommitLog:  clog,
-		Authorizer: authorizer,
-	}
-
-	serverTLS, err := setupTLSServerConfig(listener.Addr().String())
+	peerTLSConfig, err := setupTLSPeerConfig(host)
 	if err != nil {
 		return nil, err
 	}
-	server, err := server.NewGRPCServer(config, grpc.Creds(serverTLS))
+
+	a, err := agent.New(agent.Config{
+		ServerTLSConfig: serverTLSConfig,
+		PeerTLSConfig:   peerTLSConfig,
+		DataDir:         dataDir,
+		BindAddr:        c.BindAddr,
+		RPCPort:         c.RPCPort,
+		NodeName:        c.NodeName,
+		StartJoinAddrs:  c.StartJoinAddrs,
+		ACLModelFile:    config.ACLModelFile,
+		ACLPolicyFile:   config.ACLPolicyFile,
+		Bootstrap:       c.Bootstrap,
+		Durability:      c.Durability,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -105,14 +135,12 @@ func SetupGRPCServer() (*GRPCServerResult, error) {
 		return nil, err
 	}
 
-	start := func() {
-		server.Serve(listener)
-	}
-
 	cleanup := func() {
-		server.Stop()
-		listener.Close()
-		clog.Remove()
+		a.Shutdown()
+		// Only remove the data if we created a temporary directory for it.
+		if c.DataDir == "" {
+			os.RemoveAll(dataDir)
+		}
 		if telemetryExporter != nil {
 			time.Sleep(1500 * time.Millisecond)
 			telemetryExporter.Stop()
@@ -120,8 +148,8 @@ func SetupGRPCServer() (*GRPCServerResult, error) {
 		}
 	}
 
-	return &GRPCServerResult{Server: server,
-		Log:     clog,
-		Start:   start,
-		Cleanup: cleanup}, nil
+	return &AgentResult{
+		Agent:   a,
+		Cleanup: cleanup,
+	}, nil
 }
@@ -1,12 +1,50 @@
 package main
 
-import "log"
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
 
 func main() {
-	app, err := SetupGRPCServer()
+	// Maintenance subcommands run against the data on disk instead of starting the server.
+	if len(os.Args) > 1 && os.Args[1] == "rebuild-index" {
+		if err := rebuildIndex(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to rebuild index: %v", err)
+		}
+		return
+	}
+
+	var c AppConfig
+	var startJoinAddrs, sync string
+	hostname, _ := os.Hostname()
+	flag.StringVar(&c.DataDir, "data-dir", "", "Directory to store log and Raft data in, defaults to a temporary directory.")
+	flag.StringVar(&c.NodeName, "node-name", hostname, "Unique server ID.")
+	flag.StringVar(&c.BindAddr, "bind-addr", "127.0.0.1:8401", "Address to bind Serf on.")
+	flag.IntVar(&c.RPCPort, "rpc-port", 8080, "Port for RPC clients (and Raft) connections.")
+	flag.StringVar(&startJoinAddrs, "start-join-addrs", "", "Comma separated Serf addresses to join.")
+	flag.BoolVar(&c.Bootstrap, "bootstrap", false, "Bootstrap the cluster.")
+	flag.StringVar(&sync, "sync", "never", "When to fsync appended records: never, always, or an interval such as 1s.")
+	flag.Parse()
+	if startJoinAddrs != "" {
+		c.StartJoinAddrs = strings.Split(startJoinAddrs, ",")
+	}
+	var err error
+	if c.Durability, err = parseSync(sync); err != nil {
+		log.Fatal(err)
+	}
+
+	app, err := SetupAgent(c)
 	if err != nil {
-		log.Fatalf("Failed to start gRPC server: %v", err)
+		log.Fatalf("Failed to start agent: %v", err)
 	}
 	defer app.Cleanup()
-	app.Start()
+
+	// Run until we're asked to stop.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	<-sigc
 }
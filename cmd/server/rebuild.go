@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/MartinMinkov/proglog/internal/log"
+)
+
+// rebuildIndex runs the rebuild-index subcommand, which regenerates the index files of a log directory from its store files.
+// The server must be stopped while it runs.
+func rebuildIndex(args []string) error {
+	fs := flag.NewFlagSet("rebuild-index", flag.ExitOnError)
+	dir := fs.String("dir", "", "Log directory holding the segment files, e.g. {data-dir}/log.")
+	segment := fs.Int64("segment", -1, "Base offset of the only segment to rebuild, defaults to every segment.")
+	verify := fs.Bool("verify", false, "Only compare the indexes with the stores, without rewriting them.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+
+	var reports []log.IndexReport
+	if *segment >= 0 {
+		report, err := log.RebuildIndex(*dir, uint64(*segment), !*verify)
+		if err != nil {
+			return err
+		}
+		reports = append(reports, report)
+	} else {
+		var err error
+		if reports, err = log.RebuildIndexes(*dir, !*verify); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range reports {
+		status := "ok"
+		switch {
+		case r.Matches():
+		case *verify:
+			status = "mismatch"
+		default:
+			status = "rebuilt"
+		}
+		fmt.Fprintf(
+			os.Stdout,
+			"segment %d: %s entries=%d mismatched=%d missing=%d extra=%d had_index=%t tail_bytes=%d\n",
+			r.BaseOffset, status, r.Entries, r.Mismatched, r.Missing, r.Extra, r.HadIndex, r.TailBytes,
+		)
+	}
+	return nil
+}
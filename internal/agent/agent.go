@@ -0,0 +1,299 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/MartinMinkov/proglog/internal/auth"
+	"github.com/MartinMinkov/proglog/internal/discovery"
+	"github.com/MartinMinkov/proglog/internal/group"
+	"github.com/MartinMinkov/proglog/internal/log"
+	"github.com/MartinMinkov/proglog/internal/server"
+	"github.com/MartinMinkov/proglog/internal/transaction"
+	"github.com/hashicorp/raft"
+	"github.com/soheilhy/cmux"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+/**
+ * Agent runs every component that makes up a server in the cluster: the replicated log, the gRPC server and cluster membership.
+ * Raft and gRPC share a single port, connections are told apart by the first byte Raft writes.
+ */
+type Agent struct {
+	Config
+
+	mux        cmux.CMux
+	log        *log.DistributedLog
+	topics     *log.Topics
+	offsets    *log.Offsets
+	groups     *group.Coordinator
+	txns       *transaction.Coordinator
+	server     *grpc.Server
+	membership *discovery.Membership
+
+	shutdown     bool
+	shutdowns    chan struct{}
+	shutdownLock sync.Mutex
+}
+
+type Config struct {
+	ServerTLSConfig *tls.Config
+	PeerTLSConfig   *tls.Config
+	// DataDir is where the log and Raft state are stored.
+	DataDir string
+	// BindAddr is the address Serf gossips on, its host is also used for the RPC address.
+	BindAddr string
+	// RPCPort is the port gRPC and Raft listen on.
+	RPCPort int
+	// NodeName uniquely identifies this server in the cluster.
+	NodeName string
+	// StartJoinAddrs are the Serf addresses of existing servers to join.
+	StartJoinAddrs []string
+	ACLModelFile   string
+	ACLPolicyFile  string
+	// Bootstrap is set on the first server of a new cluster.
+	Bootstrap bool
+	// Durability is when the replicated log and the topics fsync appended records. Committed offsets are always fsynced.
+	Durability log.Durability
+}
+
+func (c Config) RPCAddr() (string, error) {
+	host, _, err := net.SplitHostPort(c.BindAddr)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d", host, c.RPCPort), nil
+}
+
+func New(config Config) (*Agent, error) {
+	a := &Agent{
+		Config:    config,
+		shutdowns: make(chan struct{}),
+	}
+	setup := []func() error{
+		a.setupMux,
+		a.setupLog,
+		a.setupServer,
+		a.setupMembership,
+	}
+	for _, fn := range setup {
+		if err := fn(); err != nil {
+			return nil, err
+		}
+	}
+	go a.serve()
+	return a, nil
+}
+
+func (a *Agent) setupMux() error {
+	rpcAddr, err := a.RPCAddr()
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", rpcAddr)
+	if err != nil {
+		return err
+	}
+	a.mux = cmux.New(ln)
+	return nil
+}
+
+func (a *Agent) setupLog() error {
+	// Raft connections identify themselves with their first byte, everything else is gRPC.
+	raftLn := a.mux.Match(func(reader io.Reader) bool {
+		b := make([]byte, 1)
+		if _, err := reader.Read(b); err != nil {
+			return false
+		}
+		return bytes.Equal(b, []byte{byte(log.RaftRPC)})
+	})
+	logConfig := log.Config{}
+	logConfig.Raft.StreamLayer = log.NewStreamLayer(raftLn, a.ServerTLSConfig, a.PeerTLSConfig)
+	logConfig.Raft.LocalID = raft.ServerID(a.NodeName)
+	logConfig.Raft.Bootstrap = a.Bootstrap
+	logConfig.Durability = a.Durability
+	var err error
+	a.log, err = log.NewDistributedLog(a.DataDir, logConfig)
+	if err != nil {
+		return err
+	}
+	if a.Bootstrap {
+		if err = a.log.WaitForLeader(3 * time.Second); err != nil {
+			return err
+		}
+	}
+	// Named topics are stored on this server only and are only served while it's the leader, the default topic is the replicated log.
+	topicsConfig := log.Config{}
+	topicsConfig.Durability = a.Durability
+	a.topics, err = log.NewTopics(filepath.Join(a.DataDir, "topics"), topicsConfig)
+	if err != nil {
+		return err
+	}
+	// Only the latest commit for each group and partition matters, so the offsets log is compacted.
+	offsetsConfig := log.Config{}
+	offsetsConfig.Compaction.Enabled = true
+	// A commit is only acknowledged once it's on disk whatever the other logs use, otherwise a crash could send a group back to records it already processed.
+	offsetsConfig.Durability.Sync = log.SyncAlways
+	a.offsets, err = log.NewOffsets(filepath.Join(a.DataDir, "offsets"), offsetsConfig)
+	if err != nil {
+		return err
+	}
+	a.groups = group.NewCoordinator(group.Config{
+		Partitions: a.partitions,
+	})
+	a.txns = transaction.NewCoordinator(transaction.Config{
+		WriteMarker: func(topic string, partition uint32, marker *api.Record) error {
+			clog, err := a.commitLog(topic, partition)
+			if err != nil {
+				return err
+			}
+			_, err = clog.Append(marker)
+			return err
+		},
+	})
+	return a.recoverTransactions()
+}
+
+// commitLog returns the log of a partition of the topic, the default topic is the replicated log.
+func (a *Agent) commitLog(topic string, partition uint32) (server.CommitLog, error) {
+	if topic == "" {
+		return a.log, nil
+	}
+	return a.topics.Partition(topic, partition)
+}
+
+// recoverTransactions hands the transactions left open in the logs to the coordinator, so they're ended rather than holding up read committed consumers forever.
+func (a *Agent) recoverTransactions() error {
+	for _, id := range a.log.OpenTransactions() {
+		a.txns.Recover(id, transaction.Partition{})
+	}
+	for _, topic := range a.topics.Names() {
+		partitions, err := a.topics.Partitions(topic)
+		if err != nil {
+			return err
+		}
+		for p := uint32(0); p < partitions; p++ {
+			clog, err := a.topics.Partition(topic, p)
+			if err != nil {
+				return err
+			}
+			for _, id := range clog.OpenTransactions() {
+				a.txns.Recover(id, transaction.Partition{Topic: topic, Partition: p})
+			}
+		}
+	}
+	return nil
+}
+
+// partitions returns the number of partitions in the topic, the default topic only has one.
+func (a *Agent) partitions(topic string) (uint32, error) {
+	if topic == "" {
+		return 1, nil
+	}
+	return a.topics.Partitions(topic)
+}
+
+func (a *Agent) setupServer() error {
+	authorizer := auth.New(a.ACLModelFile, a.ACLPolicyFile)
+	serverConfig := &server.Config{
+		CommitLog: a.log,
+		// Named topics aren't replicated, so a follower would create and write its own copy of them that nobody else sees.
+		// Instead followers turn them away and point at the leader, which is where load balanced clients send them anyway.
+		TopicPartitions: func(topic string) (uint32, error) {
+			if err := a.log.CheckLeader(); err != nil {
+				return 0, err
+			}
+			return a.topics.Partitions(topic)
+		},
+		TopicLog: func(topic string, partition uint32) (server.CommitLog, error) {
+			if err := a.log.CheckLeader(); err != nil {
+				return nil, err
+			}
+			return a.topics.Partition(topic, partition)
+		},
+		Offsets:      a.offsets,
+		Groups:       a.groups,
+		Transactions: a.txns,
+		Authorizer:   authorizer,
+		GetServerer:  a.log,
+	}
+	var opts []grpc.ServerOption
+	if a.ServerTLSConfig != nil {
+		creds := credentials.NewTLS(a.ServerTLSConfig)
+		opts = append(opts, grpc.Creds(creds))
+	}
+	var err error
+	a.server, err = server.NewGRPCServer(serverConfig, opts...)
+	if err != nil {
+		return err
+	}
+	grpcLn := a.mux.Match(cmux.Any())
+	go func() {
+		if err := a.server.Serve(grpcLn); err != nil {
+			_ = a.Shutdown()
+		}
+	}()
+	return nil
+}
+
+func (a *Agent) setupMembership() error {
+	rpcAddr, err := a.RPCAddr()
+	if err != nil {
+		return err
+	}
+	a.membership, err = discovery.New(a.log, discovery.Config{
+		NodeName: a.NodeName,
+		BindAddr: a.BindAddr,
+		Tags: map[string]string{
+			"rpc_addr": rpcAddr,
+		},
+		StartJoinAddrs: a.StartJoinAddrs,
+	})
+	return err
+}
+
+func (a *Agent) serve() {
+	if err := a.mux.Serve(); err != nil {
+		_ = a.Shutdown()
+	}
+}
+
+// Shutdown leaves the cluster and stops every component. It's safe to call more than once.
+func (a *Agent) Shutdown() error {
+	a.shutdownLock.Lock()
+	defer a.shutdownLock.Unlock()
+	if a.shutdown {
+		return nil
+	}
+	a.shutdown = true
+	close(a.shutdowns)
+
+	shutdown := []func() error{
+		a.membership.Leave,
+		func() error {
+			a.server.GracefulStop()
+			return nil
+		},
+		a.log.Close,
+		a.topics.Close,
+		a.offsets.Close,
+		a.groups.Close,
+		a.txns.Close,
+	}
+	for _, fn := range shutdown {
+		if err := fn(); err != nil {
+			zap.L().Named("agent").Error("failed to shut down", zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/MartinMinkov/proglog/internal/config"
+	"github.com/MartinMinkov/proglog/loadbalance"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+func TestAgent(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	var agents []*Agent
+	for i := 0; i < 3; i++ {
+		bindAddr := freeAddr(t)
+		_, rpcPort, err := net.SplitHostPort(freeAddr(t))
+		require.NoError(t, err)
+		var port int
+		_, err = fmt.Sscanf(rpcPort, "%d", &port)
+		require.NoError(t, err)
+
+		dataDir, err := os.MkdirTemp(os.TempDir(), "agent_test_log")
+		require.NoError(t, err)
+
+		// Every agent after the first joins the cluster through the first one.
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, agents[0].Config.BindAddr)
+		}
+
+		agent, err := New(Config{
+			NodeName:        fmt.Sprintf("%d", i),
+			StartJoinAddrs:  startJoinAddrs,
+			BindAddr:        bindAddr,
+			RPCPort:         port,
+			DataDir:         dataDir,
+			ACLModelFile:    config.ACLModelFile,
+			ACLPolicyFile:   config.ACLPolicyFile,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			Bootstrap:       i == 0,
+		})
+		require.NoError(t, err)
+
+		agents = append(agents, agent)
+	}
+	defer func() {
+		for _, agent := range agents {
+			_ = agent.Shutdown()
+			require.NoError(t, os.RemoveAll(agent.Config.DataDir))
+		}
+	}()
+
+	leaderClient := client(t, agents[0], peerTLSConfig)
+	// Wait until the other servers have joined the Raft cluster.
+	require.Eventually(t, func() bool {
+		res, err := leaderClient.GetServers(context.Background(), &api.GetServersRequest{})
+		return err == nil && len(res.Servers) == 3
+	}, 3*time.Second, 100*time.Millisecond)
+
+	produceResponse, err := leaderClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("foo"),
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	consumeResponse, err := leaderClient.Consume(
+		context.Background(),
+		&api.ConsumeRequest{
+			Offset: produceResponse.Offset,
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, consumeResponse.Record.Value, []byte("foo"))
+
+	// Followers should eventually have the record replicated to them.
+	followerClient := client(t, agents[1], peerTLSConfig)
+	require.Eventually(t, func() bool {
+		consumeResponse, err = followerClient.Consume(
+			context.Background(),
+			&api.ConsumeRequest{
+				Offset: produceResponse.Offset,
+			},
+		)
+		return err == nil
+	}, 3*time.Second, 100*time.Millisecond)
+	require.Equal(t, consumeResponse.Record.Value, []byte("foo"))
+
+	// A load balanced client discovers the cluster through any server and sends produces to the leader.
+	lbClient := loadBalancedClient(t, agents[1], peerTLSConfig)
+	produceResponse, err = lbClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("bar"),
+			},
+		},
+	)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		consumeResponse, err = lbClient.Consume(
+			context.Background(),
+			&api.ConsumeRequest{
+				Offset: produceResponse.Offset,
+			},
+		)
+		return err == nil
+	}, 3*time.Second, 100*time.Millisecond)
+	require.Equal(t, consumeResponse.Record.Value, []byte("bar"))
+
+	// Followers don't keep named topics, so they turn away writes to them and name the leader instead.
+	_, err = followerClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Topic:  "orders",
+			Record: &api.Record{Value: []byte("baz")},
+		},
+	)
+	notLeader := status.Convert(err)
+	require.Equal(t, codes.FailedPrecondition, notLeader.Code())
+	leaderAddr, err := agents[0].Config.RPCAddr()
+	require.NoError(t, err)
+	require.Contains(t, notLeader.Message(), leaderAddr)
+
+	// Named topics are only on the leader, so the load balanced client consumes them from there rather than from a follower.
+	produceResponse, err = lbClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Topic:  "orders",
+			Record: &api.Record{Value: []byte("baz")},
+		},
+	)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		consumeResponse, err = lbClient.Consume(
+			context.Background(),
+			&api.ConsumeRequest{
+				Topic:     "orders",
+				Partition: produceResponse.Partition,
+				Offset:    produceResponse.Offset,
+			},
+		)
+		require.NoError(t, err)
+		require.Equal(t, []byte("baz"), consumeResponse.Record.Value)
+	}
+	// The stream waits for more records until it's cancelled, which shutting down the servers would wait for.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := lbClient.ConsumeStream(
+		ctx,
+		&api.ConsumeRequest{
+			Topic:     "orders",
+			Partition: produceResponse.Partition,
+			Offset:    produceResponse.Offset,
+		},
+	)
+	require.NoError(t, err)
+	streamed, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("baz"), streamed.Record.Value)
+	cancel()
+}
+
+func loadBalancedClient(t *testing.T, agent *Agent, tlsConfig *tls.Config) api.LogClient {
+	t.Helper()
+	tlsCreds := credentials.NewTLS(tlsConfig)
+	opts := append([]grpc.DialOption{grpc.WithTransportCredentials(tlsCreds)}, loadbalance.DialOptions()...)
+	rpcAddr, err := agent.Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.NewClient(fmt.Sprintf("%s:///%s", loadbalance.Name, rpcAddr), opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return api.NewLogClient(conn)
+}
+
+func client(t *testing.T, agent *Agent, tlsConfig *tls.Config) api.LogClient {
+	t.Helper()
+	tlsCreds := credentials.NewTLS(tlsConfig)
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(tlsCreds)}
+	rpcAddr, err := agent.Config.RPCAddr()
+	require.NoError(t, err)
+	conn, err := grpc.NewClient(rpcAddr, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return api.NewLogClient(conn)
+}
+
+// freeAddr finds an unused loopback port.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
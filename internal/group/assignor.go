@@ -0,0 +1,193 @@
+package group
+
+import (
+	"sort"
+)
+
+// Assignment maps each member ID to the partitions it's assigned, by topic.
+type Assignment map[string]map[string][]uint32
+
+// Member is a consumer in a group and the topics it subscribes to.
+type Member struct {
+	ID     string
+	Topics []string
+}
+
+// Assignor splits the partitions of the group's topics between its members.
+type Assignor interface {
+	Name() string
+	// Assign returns the new assignment given the members, the number of partitions in each topic and the previous assignment.
+	Assign(members []Member, partitions map[string]uint32, previous Assignment) Assignment
+}
+
+var _ Assignor = RangeAssignor{}
+
+/**
+ * RangeAssignor gives each member a contiguous range of every topic's partitions.
+ * Members are sorted by ID, and the first members get an extra partition when they don't divide evenly.
+ */
+type RangeAssignor struct{}
+
+func (RangeAssignor) Name() string {
+	return "range"
+}
+
+func (RangeAssignor) Assign(members []Member, partitions map[string]uint32, _ Assignment) Assignment {
+	assignment := newAssignment(members)
+	for topic, count := range partitions {
+		subscribers := subscribersOf(members, topic)
+		if len(subscribers) == 0 {
+			continue
+		}
+		per := count / uint32(len(subscribers))
+		extra := count % uint32(len(subscribers))
+		var next uint32
+		for i, id := range subscribers {
+			n := per
+			if uint32(i) < extra {
+				n++
+			}
+			for p := next; p < next+n; p++ {
+				assignment[id][topic] = append(assignment[id][topic], p)
+			}
+			next += n
+		}
+	}
+	return assignment
+}
+
+var _ Assignor = StickyAssignor{}
+
+/**
+ * StickyAssignor keeps as many partitions as possible with the member that had them before, while keeping the assignment balanced.
+ * Members keep their previous partitions, unowned partitions go to the member with the fewest, and then partitions are moved from the busiest members until no member has more than one partition over another.
+ */
+type StickyAssignor struct{}
+
+func (StickyAssignor) Name() string {
+	return "sticky"
+}
+
+type topicPartition struct {
+	topic     string
+	partition uint32
+}
+
+func (StickyAssignor) Assign(members []Member, partitions map[string]uint32, previous Assignment) Assignment {
+	owned := make(map[string][]topicPartition, len(members))
+	owner := make(map[topicPartition]string)
+	subscribed := make(map[string]map[string]bool, len(members))
+	var ids []string
+	for _, m := range members {
+		ids = append(ids, m.ID)
+		subscribed[m.ID] = make(map[string]bool, len(m.Topics))
+		for _, topic := range m.Topics {
+			subscribed[m.ID][topic] = true
+		}
+	}
+	sort.Strings(ids)
+
+	// Keep the partitions members owned before, as long as they still exist and are still subscribed to.
+	for _, id := range ids {
+		for topic, ps := range previous[id] {
+			for _, p := range ps {
+				tp := topicPartition{topic: topic, partition: p}
+				if _, taken := owner[tp]; taken || !subscribed[id][topic] || p >= partitions[topic] {
+					continue
+				}
+				owner[tp] = id
+				owned[id] = append(owned[id], tp)
+			}
+		}
+	}
+
+	// Give every unowned partition to the eligible member with the fewest partitions.
+	for _, tp := range sortedPartitions(partitions) {
+		if _, taken := owner[tp]; taken {
+			continue
+		}
+		var best string
+		for _, id := range ids {
+			if subscribed[id][tp.topic] && (best == "" || len(owned[id]) < len(owned[best])) {
+				best = id
+			}
+		}
+		if best == "" {
+			continue
+		}
+		owner[tp] = best
+		owned[best] = append(owned[best], tp)
+	}
+
+	// Move partitions from the busiest members to the least busy ones until the assignment is balanced.
+	for moved := true; moved; {
+		moved = false
+		for _, from := range ids {
+			for i := 0; i < len(owned[from]); i++ {
+				tp := owned[from][i]
+				for _, to := range ids {
+					if !subscribed[to][tp.topic] || len(owned[from]) <= len(owned[to])+1 {
+						continue
+					}
+					owned[from] = append(owned[from][:i], owned[from][i+1:]...)
+					owned[to] = append(owned[to], tp)
+					i--
+					moved = true
+					break
+				}
+			}
+		}
+	}
+
+	assignment := newAssignment(members)
+	for id, tps := range owned {
+		for _, tp := range tps {
+			assignment[id][tp.topic] = append(assignment[id][tp.topic], tp.partition)
+		}
+		for topic := range assignment[id] {
+			sort.Slice(assignment[id][topic], func(i, j int) bool {
+				return assignment[id][topic][i] < assignment[id][topic][j]
+			})
+		}
+	}
+	return assignment
+}
+
+func newAssignment(members []Member) Assignment {
+	assignment := make(Assignment, len(members))
+	for _, m := range members {
+		assignment[m.ID] = make(map[string][]uint32)
+	}
+	return assignment
+}
+
+// subscribersOf returns the sorted IDs of the members subscribed to the topic.
+func subscribersOf(members []Member, topic string) []string {
+	var ids []string
+	for _, m := range members {
+		for _, t := range m.Topics {
+			if t == topic {
+				ids = append(ids, m.ID)
+				break
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func sortedPartitions(partitions map[string]uint32) []topicPartition {
+	var tps []topicPartition
+	for topic, count := range partitions {
+		for p := uint32(0); p < count; p++ {
+			tps = append(tps, topicPartition{topic: topic, partition: p})
+		}
+	}
+	sort.Slice(tps, func(i, j int) bool {
+		if tps[i].topic != tps[j].topic {
+			return tps[i].topic < tps[j].topic
+		}
+		return tps[i].partition < tps[j].partition
+	})
+	return tps
+}
@@ -0,0 +1,59 @@
+package group
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeAssignor(t *testing.T) {
+	members := []Member{
+		{ID: "b", Topics: []string{"orders", "payments"}},
+		{ID: "a", Topics: []string{"orders"}},
+	}
+	got := RangeAssignor{}.Assign(members, map[string]uint32{"orders": 5, "payments": 2}, nil)
+	require.Equal(t, Assignment{
+		"a": {"orders": {0, 1, 2}},
+		"b": {"orders": {3, 4}, "payments": {0, 1}},
+	}, got)
+}
+
+func TestStickyAssignor(t *testing.T) {
+	partitions := map[string]uint32{"orders": 6}
+	members := []Member{
+		{ID: "a", Topics: []string{"orders"}},
+		{ID: "b", Topics: []string{"orders"}},
+	}
+	first := StickyAssignor{}.Assign(members, partitions, nil)
+	require.Len(t, first["a"]["orders"], 3)
+	require.Len(t, first["b"]["orders"], 3)
+
+	// A new member takes partitions from the existing ones, which keep the rest of what they had.
+	members = append(members, Member{ID: "c", Topics: []string{"orders"}})
+	second := StickyAssignor{}.Assign(members, partitions, first)
+	for _, id := range []string{"a", "b", "c"} {
+		require.Len(t, second[id]["orders"], 2)
+	}
+	for _, id := range []string{"a", "b"} {
+		require.Subset(t, first[id]["orders"], second[id]["orders"])
+	}
+
+	// When a member leaves, only its partitions move.
+	members = members[1:]
+	third := StickyAssignor{}.Assign(members, partitions, second)
+	for _, id := range []string{"b", "c"} {
+		require.Len(t, third[id]["orders"], 3)
+		require.Subset(t, third[id]["orders"], second[id]["orders"])
+	}
+}
+
+func TestStickyAssignorRespectsSubscriptions(t *testing.T) {
+	members := []Member{
+		{ID: "a", Topics: []string{"orders"}},
+		{ID: "b", Topics: []string{"orders", "payments"}},
+	}
+	got := StickyAssignor{}.Assign(members, map[string]uint32{"orders": 2, "payments": 2}, nil)
+	require.Empty(t, got["a"]["payments"])
+	require.Len(t, got["b"]["payments"], 2)
+	require.Len(t, append(got["a"]["orders"], got["b"]["orders"]...), 2)
+}
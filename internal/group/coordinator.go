@@ -0,0 +1,262 @@
+package group
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/**
+ * Coordinator assigns the partitions of a consumer group's topics to its live members.
+ * Whenever a member joins, leaves or stops heartbeating, the group moves to a new generation and its partitions are reassigned.
+ * Members find out about a rebalance from their heartbeats and then sync to fetch their new assignment.
+ */
+type Coordinator struct {
+	Config
+
+	mu      sync.Mutex
+	groups  map[string]*group
+	members uint64
+	logger  *zap.Logger
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+type Config struct {
+	// SessionTimeout is how long a member can go without a heartbeat before it's removed from its group.
+	SessionTimeout time.Duration
+	// Partitions returns the number of partitions in a topic.
+	Partitions func(topic string) (uint32, error)
+	// Assignors are the assignment strategies members can choose from, defaults to range and sticky.
+	Assignors []Assignor
+}
+
+type group struct {
+	name       string
+	generation uint64
+	assignor   Assignor
+	members    map[string]*member
+	assignment Assignment
+}
+
+type member struct {
+	Member
+	lastHeartbeat time.Time
+}
+
+func NewCoordinator(config Config) *Coordinator {
+	if config.SessionTimeout == 0 {
+		config.SessionTimeout = 10 * time.Second
+	}
+	if config.Assignors == nil {
+		config.Assignors = []Assignor{RangeAssignor{}, StickyAssignor{}}
+	}
+	c := &Coordinator{
+		Config: config,
+		groups: make(map[string]*group),
+		logger: zap.L().Named("coordinator"),
+		closed: make(chan struct{}),
+	}
+	go c.expireMembers()
+	return c
+}
+
+// Join adds a member to the group, or updates the subscription of an existing member, and rebalances the group.
+func (c *Coordinator) Join(groupName, memberID string, topics []string, strategy string) (string, uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, ok := c.groups[groupName]
+	if !ok {
+		g = &group{name: groupName, members: make(map[string]*member)}
+	}
+	assignor, err := c.assignor(g, strategy)
+	if err != nil {
+		return "", 0, err
+	}
+	// Check the topics exist before changing the group, so a bad subscription can't break its rebalances.
+	for _, topic := range topics {
+		if _, err := c.Partitions(topic); err != nil {
+			return "", 0, err
+		}
+	}
+	if memberID == "" {
+		c.members++
+		memberID = fmt.Sprintf("%s-%d", groupName, c.members)
+	} else if _, ok := g.members[memberID]; !ok {
+		return "", 0, api.ErrUnknownMember{Group: groupName, Member: memberID}
+	}
+	g.assignor = assignor
+	g.members[memberID] = &member{
+		Member:        Member{ID: memberID, Topics: topics},
+		lastHeartbeat: time.Now(),
+	}
+	c.groups[groupName] = g
+	if err := c.rebalance(g); err != nil {
+		return "", 0, err
+	}
+	return memberID, g.generation, nil
+}
+
+// assignor returns the assignor for the strategy, which must match the one the group already uses.
+func (c *Coordinator) assignor(g *group, strategy string) (Assignor, error) {
+	if g.assignor != nil && len(g.members) > 0 && g.assignor.Name() != strategy {
+		return nil, status.Errorf(codes.FailedPrecondition, "group %q uses the %q strategy", g.name, g.assignor.Name())
+	}
+	for _, a := range c.Assignors {
+		if a.Name() == strategy {
+			return a, nil
+		}
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "unknown assignment strategy %q", strategy)
+}
+
+// Sync returns the member's partitions for the group's current generation.
+func (c *Coordinator) Sync(groupName, memberID string) (uint64, map[string][]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, m, err := c.member(groupName, memberID)
+	if err != nil {
+		return 0, nil, err
+	}
+	m.lastHeartbeat = time.Now()
+	return g.generation, g.assignment[memberID], nil
+}
+
+// Heartbeat keeps the member in the group and reports whether the group has moved on from the member's generation.
+func (c *Coordinator) Heartbeat(groupName, memberID string, generation uint64) (uint64, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, m, err := c.member(groupName, memberID)
+	if err != nil {
+		return 0, false, err
+	}
+	m.lastHeartbeat = time.Now()
+	return g.generation, generation != g.generation, nil
+}
+
+// Leave removes the member from the group and rebalances its partitions to the remaining members.
+func (c *Coordinator) Leave(groupName, memberID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, _, err := c.member(groupName, memberID)
+	if err != nil {
+		return err
+	}
+	delete(g.members, memberID)
+	return c.rebalance(g)
+}
+
+// Topics returns the topics the group's members subscribe to, in order. An unknown group has none.
+func (c *Coordinator) Topics(groupName string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, ok := c.groups[groupName]
+	if !ok {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var topics []string
+	for _, m := range g.members {
+		for _, topic := range m.Topics {
+			if !seen[topic] {
+				seen[topic] = true
+				topics = append(topics, topic)
+			}
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// CheckGeneration fails unless the member is in the group and on its current generation, so a member can't commit offsets for partitions a rebalance has handed to someone else.
+func (c *Coordinator) CheckGeneration(groupName, memberID string, generation uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, _, err := c.member(groupName, memberID)
+	if err != nil {
+		return err
+	}
+	if generation != g.generation {
+		return api.ErrStaleGeneration{Group: groupName, Member: memberID, Generation: generation}
+	}
+	return nil
+}
+
+func (c *Coordinator) member(groupName, memberID string) (*group, *member, error) {
+	g, ok := c.groups[groupName]
+	if !ok {
+		return nil, nil, api.ErrUnknownMember{Group: groupName, Member: memberID}
+	}
+	m, ok := g.members[memberID]
+	if !ok {
+		return nil, nil, api.ErrUnknownMember{Group: groupName, Member: memberID}
+	}
+	return g, m, nil
+}
+
+// rebalance moves the group to a new generation and reassigns its partitions. The caller must hold c.mu.
+func (c *Coordinator) rebalance(g *group) error {
+	partitions := make(map[string]uint32)
+	members := make([]Member, 0, len(g.members))
+	for _, m := range g.members {
+		members = append(members, m.Member)
+		for _, topic := range m.Topics {
+			if _, ok := partitions[topic]; ok {
+				continue
+			}
+			count, err := c.Partitions(topic)
+			if err != nil {
+				return err
+			}
+			partitions[topic] = count
+		}
+	}
+	g.generation++
+	g.assignment = g.assignor.Assign(members, partitions, g.assignment)
+	return nil
+}
+
+// expireMembers removes members whose session has timed out and rebalances their groups.
+func (c *Coordinator) expireMembers() {
+	ticker := time.NewTicker(c.SessionTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			for _, g := range c.groups {
+				expired := false
+				for id, m := range g.members {
+					if now.Sub(m.lastHeartbeat) > c.SessionTimeout {
+						delete(g.members, id)
+						expired = true
+					}
+				}
+				if !expired {
+					continue
+				}
+				if err := c.rebalance(g); err != nil {
+					c.logger.Error("failed to rebalance", zap.String("group", g.name), zap.Error(err))
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// Close stops expiring members.
+func (c *Coordinator) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
@@ -0,0 +1,147 @@
+package group
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCoordinator(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, c *Coordinator){
+		"members split the partitions":        testMembersSplitPartitions,
+		"expired members are rebalanced away": testExpiredMembers,
+		"leaving members are rebalanced away": testLeavingMembers,
+		"members must agree on the strategy":  testInconsistentStrategy,
+		"unknown members are told to rejoin":  testUnknownMember,
+		"members are checked for generation":  testCheckGeneration,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			c := NewCoordinator(Config{
+				SessionTimeout: 100 * time.Millisecond,
+				Partitions: func(topic string) (uint32, error) {
+					return 6, nil
+				},
+			})
+			defer c.Close()
+			fn(t, c)
+		})
+	}
+}
+
+// consumer is a fake group member that joins, heartbeats and syncs its assignment.
+type consumer struct {
+	t          *testing.T
+	c          *Coordinator
+	id         string
+	generation uint64
+	partitions []uint32
+}
+
+func join(t *testing.T, c *Coordinator, strategy string) *consumer {
+	t.Helper()
+	id, generation, err := c.Join("billing", "", []string{"orders"}, strategy)
+	require.NoError(t, err)
+	return &consumer{t: t, c: c, id: id, generation: generation}
+}
+
+// heartbeat syncs the consumer's assignment if the group has rebalanced.
+func (f *consumer) heartbeat() {
+	f.t.Helper()
+	_, rebalance, err := f.c.Heartbeat("billing", f.id, f.generation)
+	require.NoError(f.t, err)
+	if rebalance || f.partitions == nil {
+		generation, assignment, err := f.c.Sync("billing", f.id)
+		require.NoError(f.t, err)
+		f.generation = generation
+		f.partitions = assignment["orders"]
+		if f.partitions == nil {
+			f.partitions = []uint32{}
+		}
+	}
+}
+
+// requireAssigned checks every partition is assigned to exactly one consumer, with the given number each.
+func requireAssigned(t *testing.T, consumers []*consumer, each int) {
+	t.Helper()
+	var all []uint32
+	for _, f := range consumers {
+		f.heartbeat()
+		require.Len(t, f.partitions, each)
+		all = append(all, f.partitions...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	require.Equal(t, []uint32{0, 1, 2, 3, 4, 5}, all)
+}
+
+func testMembersSplitPartitions(t *testing.T, c *Coordinator) {
+	consumers := []*consumer{join(t, c, "range")}
+	requireAssigned(t, consumers, 6)
+	consumers = append(consumers, join(t, c, "range"), join(t, c, "range"))
+	requireAssigned(t, consumers, 2)
+}
+
+func testExpiredMembers(t *testing.T, c *Coordinator) {
+	consumers := []*consumer{join(t, c, "sticky"), join(t, c, "sticky"), join(t, c, "sticky")}
+	requireAssigned(t, consumers, 2)
+	kept := append([]uint32{}, consumers[0].partitions...)
+
+	// The last consumer stops heartbeating while the others carry on.
+	deadline := time.Now().Add(300 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		consumers[0].heartbeat()
+		consumers[1].heartbeat()
+		time.Sleep(20 * time.Millisecond)
+	}
+	requireAssigned(t, consumers[:2], 3)
+	// With the sticky strategy the surviving consumers keep their partitions.
+	require.Subset(t, consumers[0].partitions, kept)
+
+	_, _, err := c.Heartbeat("billing", consumers[2].id, consumers[2].generation)
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testLeavingMembers(t *testing.T, c *Coordinator) {
+	consumers := []*consumer{join(t, c, "range"), join(t, c, "range")}
+	requireAssigned(t, consumers, 3)
+	require.NoError(t, c.Leave("billing", consumers[1].id))
+	requireAssigned(t, consumers[:1], 6)
+}
+
+func testInconsistentStrategy(t *testing.T, c *Coordinator) {
+	join(t, c, "range")
+	_, _, err := c.Join("billing", "", []string{"orders"}, "sticky")
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, _, err = c.Join("shipping", "", []string{"orders"}, "unknown")
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testUnknownMember(t *testing.T, c *Coordinator) {
+	_, _, err := c.Sync("billing", "billing-42")
+	require.Equal(t, api.ErrUnknownMember{Group: "billing", Member: "billing-42"}, err)
+	_, _, err = c.Join("billing", "billing-42", []string{"orders"}, "range")
+	require.Equal(t, api.ErrUnknownMember{Group: "billing", Member: "billing-42"}, err)
+}
+
+func testCheckGeneration(t *testing.T, c *Coordinator) {
+	first := join(t, c, "range")
+	require.NoError(t, c.CheckGeneration("billing", first.id, first.generation))
+	second, _, err := c.Join("billing", "", []string{"payments"}, "range")
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders", "payments"}, c.Topics("billing"))
+	require.Empty(t, c.Topics("shipping"))
+
+	// The group moved on when the second member joined, so the first member's generation is stale until it syncs.
+	err = c.CheckGeneration("billing", first.id, first.generation)
+	require.Equal(t, api.ErrStaleGeneration{Group: "billing", Member: first.id, Generation: first.generation}, err)
+	first.heartbeat()
+	require.NoError(t, c.CheckGeneration("billing", first.id, first.generation))
+
+	require.NoError(t, c.Leave("billing", second))
+	err = c.CheckGeneration("billing", second, first.generation)
+	require.Equal(t, api.ErrUnknownMember{Group: "billing", Member: second}, err)
+}
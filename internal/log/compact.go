@@ -0,0 +1,220 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+)
+
+// cleanedExt is appended to the file names of a segment while the cleaner rewrites it.
+const cleanedExt = ".cleaned"
+
+/**
+ * Compact rewrites the sealed segments so they only keep the latest record for each key.
+ * Records without a key are never compacted. A record with a key and an empty value is a tombstone: it deletes the key and is itself dropped once its segment is older than the tombstone retention.
+ * Records keep their original offsets, so a compacted segment has gaps and reads of a removed offset return the next record instead.
+ * The active segment is never rewritten, but its records still supersede older ones with the same key.
+ * Only records read committed consumers see can supersede or be removed. Transaction markers, aborted records and everything from the last stable offset on are kept as they are,
+ * otherwise an aborted or still open write would take away the committed value it was meant to replace.
+ */
+func (l *Log) Compact() error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	l.mu.RLock()
+	sealed := make([]*segment, len(l.segments)-1)
+	copy(sealed, l.segments)
+	active := l.activeSegment
+	// The segments are read without the log lock, so we work from the transactions as they were when we started.
+	txns := l.transactions.copy()
+	stable := txns.stable(active.nextOffset)
+	l.mu.RUnlock()
+
+	// Later records overwrite earlier ones, so we end up with the latest offset for every key.
+	latest := make(map[string]uint64)
+	track := func(record *api.Record) error {
+		if len(record.Key) > 0 && compactable(record, txns, stable) {
+			latest[string(record.Key)] = record.Offset
+		}
+		return nil
+	}
+	// Appends only ever go to the active segment, so the sealed segments can be read without holding the log lock.
+	for _, s := range sealed {
+		if err := s.forEach(track); err != nil {
+			return err
+		}
+	}
+	// We hold the read lock while scanning the active segment so it is not written to while we read it.
+	l.mu.RLock()
+	err := active.forEach(track)
+	l.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range sealed {
+		if err := l.compactSegment(s, latest, txns, stable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactable reports whether compaction may let the record supersede or remove others: it has to be committed and before the last stable offset.
+func compactable(record *api.Record, txns *transactions, stable uint64) bool {
+	return record.Offset < stable && txns.committed(record)
+}
+
+// compactSegment rewrites the segment into .cleaned files with only the records worth keeping and swaps them in.
+func (l *Log) compactSegment(s *segment, latest map[string]uint64, txns *transactions, stable uint64) error {
+	modTime, err := s.modTime()
+	if err != nil {
+		return err
+	}
+	expired := time.Since(modTime) > l.Config.Compaction.TombstoneRetention
+
+	var keep []*api.Record
+	total := 0
+	err = s.forEach(func(record *api.Record) error {
+		total++
+		if len(record.Key) > 0 && compactable(record, txns, stable) {
+			if latest[string(record.Key)] != record.Offset {
+				return nil
+			}
+			if len(record.Value) == 0 && expired {
+				return nil
+			}
+		}
+		keep = append(keep, record)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Nothing to drop, so there is no point in rewriting the segment.
+	if len(keep) == total {
+		return nil
+	}
+
+	cleaned, err := openSegment(l.Dir, s.baseOffset, cleanedExt, l.Config)
+	if err != nil {
+		return err
+	}
+	// With a codec configured, the records that are left are compressed together again.
+	if codec := l.Config.Segment.Codec; codec != api.Codec_CODEC_NONE && len(keep) > 0 {
+		err = cleaned.appendBatch(keep, codec)
+	} else {
+		for _, record := range keep {
+			if _, err = cleaned.append(record); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		cleaned.Remove()
+		return err
+	}
+	if err = cleaned.Close(); err != nil {
+		return err
+	}
+	// The rewritten store keeps the original modification time so tombstones still expire on schedule.
+	storePath := segmentPath(l.Dir, s.baseOffset, ".store")
+	if err = os.Chtimes(storePath+cleanedExt, modTime, modTime); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := l.segmentIndex(s)
+	// The segment was removed while we were rewriting it, so the cleaned copy is no longer needed.
+	if i < 0 {
+		return removeCleaned(l.Dir, s.baseOffset)
+	}
+	// Segments left empty are removed, apart from the first one which marks where the log starts.
+	if len(keep) == 0 && i > 0 {
+		if err = removeCleaned(l.Dir, s.baseOffset); err != nil {
+			return err
+		}
+		if err = s.Remove(); err != nil {
+			return err
+		}
+		l.segments = append(l.segments[:i], l.segments[i+1:]...)
+		l.publish()
+		return nil
+	}
+	if err = s.Close(); err != nil {
+		return err
+	}
+	// The store is renamed first, so if we crash before the other files follow it, setup finds them on their own and finishes the swap.
+	for _, ext := range segmentExts {
+		p := segmentPath(l.Dir, s.baseOffset, ext)
+		if err = os.Rename(p+cleanedExt, p); err != nil {
+			return err
+		}
+	}
+	swapped, err := newSegment(l.Dir, s.baseOffset, l.Config)
+	if err != nil {
+		return err
+	}
+	// The segment still owns the offsets up to the next segment, even if its last records were dropped.
+	swapped.nextOffset = s.nextOffset
+	l.segments[i] = swapped
+	l.publish()
+	return nil
+}
+
+// segmentIndex returns the position of the segment in the log, or -1 if it is no longer part of the log.
+func (l *Log) segmentIndex(s *segment) int {
+	i := findSegment(l.segments, s.baseOffset)
+	if i < 0 || l.segments[i] != s {
+		return -1
+	}
+	return i
+}
+
+// segmentExts are the extensions of a segment's files, starting with the store.
+var segmentExts = []string{".store", ".timeindex", ".index"}
+
+func removeCleaned(dir string, baseOffset uint64) error {
+	for _, ext := range segmentExts {
+		err := os.Remove(segmentPath(dir, baseOffset, ext+cleanedExt))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverCleaned finishes or discards compactions that were interrupted by a crash.
+// If the cleaned store is gone, it was already swapped in and the other files have to follow it. Otherwise the rewrite never completed and the original files are still intact.
+func recoverCleaned(dir string, files []os.DirEntry) error {
+	cleanedStores := make(map[string]bool)
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".store"+cleanedExt) {
+			cleanedStores[strings.TrimSuffix(file.Name(), ".store"+cleanedExt)] = true
+		}
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, cleanedExt) {
+			continue
+		}
+		p := path.Join(dir, name)
+		original := strings.TrimSuffix(name, cleanedExt)
+		base := strings.TrimSuffix(original, path.Ext(original))
+		if !cleanedStores[base] {
+			if err := os.Rename(p, strings.TrimSuffix(p, cleanedExt)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
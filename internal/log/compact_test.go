@@ -0,0 +1,222 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompact(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, log *Log,
+	){
+		"keeps the latest record for each key":     testCompactLatest,
+		"keeps unexpired tombstones":               testCompactTombstoneRetained,
+		"removes expired tombstones":               testCompactTombstoneExpired,
+		"discards an interrupted compaction":       testCompactInterrupted,
+		"finishes a compaction that swapped store": testCompactSwappedStore,
+		"compacts compressed batches":              testCompactBatches,
+		"keeps values aborted writes replaced":     testCompactAborted,
+		"keeps values open transactions replace":   testCompactOpenTransaction,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp(os.TempDir(), "compact_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			// Every record gets its own segment, so all but the last one are sealed.
+			c.Segment.MaxStoreBytes = 1
+			c.Compaction.TombstoneRetention = time.Hour
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			fn(t, log)
+		})
+	}
+}
+
+func appendKeyed(t *testing.T, log *Log, records ...[2]string) {
+	t.Helper()
+	for _, r := range records {
+		_, err := log.Append(&api.Record{Key: []byte(r[0]), Value: []byte(r[1])})
+		require.NoError(t, err)
+	}
+}
+
+func testCompactLatest(t *testing.T, log *Log) {
+	appendKeyed(t, log,
+		[2]string{"a", "1"},
+		[2]string{"b", "1"},
+		[2]string{"a", "2"},
+		[2]string{"", "no key"},
+		[2]string{"b", "2"},
+	)
+	require.NoError(t, log.Compact())
+
+	// The removed offset reads as the next record that was kept.
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), record.Offset)
+	require.Equal(t, []byte("2"), record.Value)
+
+	record, err = log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("no key"), record.Value)
+
+	record, err = log.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), record.Offset)
+
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	// Appends continue at the next offset and the compacted log survives a restart.
+	off, err = log.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, log.Close())
+
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	record, err = n.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), record.Offset)
+	off, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+}
+
+func testCompactTombstoneRetained(t *testing.T, log *Log) {
+	appendKeyed(t, log,
+		[2]string{"a", "1"},
+		[2]string{"a", ""},
+		[2]string{"b", "1"},
+	)
+	require.NoError(t, log.Compact())
+
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), record.Offset)
+	require.Empty(t, record.Value)
+}
+
+func testCompactTombstoneExpired(t *testing.T, log *Log) {
+	log.Config.Compaction.TombstoneRetention = 0
+	appendKeyed(t, log,
+		[2]string{"a", "1"},
+		[2]string{"a", ""},
+		[2]string{"b", "1"},
+	)
+	require.NoError(t, log.Compact())
+
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), record.Offset)
+	// The first segment is kept even though it is empty, so the log still starts at offset 0.
+	require.Equal(t, 3, len(log.segments))
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+func testCompactInterrupted(t *testing.T, log *Log) {
+	appendKeyed(t, log,
+		[2]string{"a", "1"},
+		[2]string{"a", "2"},
+	)
+	require.NoError(t, log.Close())
+	for _, name := range []string{"0.store.cleaned", "0.index.cleaned"} {
+		require.NoError(t, os.WriteFile(filepath.Join(log.Dir, name), nil, 0644))
+	}
+
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	record, err := n.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), record.Value)
+	matches, err := filepath.Glob(filepath.Join(log.Dir, "*"+cleanedExt))
+	require.NoError(t, err)
+	require.Empty(t, matches)
+}
+
+func testCompactSwappedStore(t *testing.T, log *Log) {
+	appendKeyed(t, log,
+		[2]string{"a", "1"},
+		[2]string{"b", "1"},
+	)
+	require.NoError(t, log.Close())
+	// The crash happened after the store was renamed, so the index left behind belongs to the store on disk.
+	index := filepath.Join(log.Dir, "0.index")
+	require.NoError(t, os.Rename(index, index+cleanedExt))
+
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	record, err := n.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), record.Key)
+}
+
+func testCompactBatches(t *testing.T, log *Log) {
+	log.Config.Segment.Codec = api.Codec_CODEC_SNAPPY
+	// The whole batch lands in the first segment, which is sealed afterwards.
+	_, err := log.AppendBatch([]*api.Record{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("1")},
+		{Key: []byte("a"), Value: []byte("2")},
+	})
+	require.NoError(t, err)
+	require.NoError(t, log.Compact())
+
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), record.Offset)
+	record, err = log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), record.Value)
+}
+
+func testCompactAborted(t *testing.T, log *Log) {
+	appendKeyed(t, log, [2]string{"a", "1"})
+	_, err := log.Append(&api.Record{Key: []byte("a"), Value: []byte("2"), TransactionId: 7})
+	require.NoError(t, err)
+	endTransaction(t, log, 7, api.ControlType_CONTROL_ABORT)
+	appendKeyed(t, log, [2]string{"b", "1"})
+	require.NoError(t, log.Compact())
+
+	// The aborted write never happened as far as read committed consumers are concerned, so the value it would have replaced is still there.
+	require.Equal(t, []string{"1", "1"}, readCommitted(t, log))
+	// The aborted record and its marker are kept too, so the transaction is still known to be aborted when the log is opened again.
+	for off := uint64(0); off < 3; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	require.Equal(t, []string{"1", "1"}, readCommitted(t, n))
+}
+
+func testCompactOpenTransaction(t *testing.T, log *Log) {
+	appendKeyed(t, log, [2]string{"a", "1"})
+	_, err := log.Append(&api.Record{Key: []byte("a"), Value: []byte("2"), TransactionId: 7})
+	require.NoError(t, err)
+	appendKeyed(t, log, [2]string{"b", "1"})
+	require.NoError(t, log.Compact())
+
+	// Until the transaction ends we don't know whether its write replaces the first one.
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), record.Offset)
+	endTransaction(t, log, 7, api.ControlType_CONTROL_ABORT)
+	require.Equal(t, []string{"1", "1"}, readCommitted(t, log))
+}
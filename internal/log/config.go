@@ -1,9 +1,74 @@
 package log
 
+import (
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/hashicorp/raft"
+)
+
 type Config struct {
+	Raft struct {
+		raft.Config
+		// StreamLayer is the transport Raft uses to talk to the other servers in the cluster.
+		StreamLayer *StreamLayer
+		// Bootstrap is set on the first server of a cluster so it can elect itself as the leader.
+		Bootstrap bool
+	}
+	Topic struct {
+		// Partitions is the number of partitions new topics are created with.
+		Partitions uint32
+	}
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// Codec compresses the records appended in a batch as a single frame. Records appended one at a time are stored uncompressed.
+		Codec api.Codec
+	}
+	Compaction struct {
+		// Enabled starts a background cleaner that keeps only the latest record for each key in the sealed segments.
+		Enabled bool
+		// Interval is how often the cleaner runs. It defaults to a minute.
+		Interval time.Duration
+		// TombstoneRetention is how long a record with a key and no value is kept after its segment was written, so consumers have a chance to see the delete.
+		TombstoneRetention time.Duration
 	}
+	Retention struct {
+		// MaxAge removes sealed segments that were last written to longer ago than this.
+		MaxAge time.Duration
+		// MaxBytes removes the oldest sealed segments while the log takes up more than this many bytes.
+		MaxBytes uint64
+		// MaxSegments removes the oldest sealed segments while the log has more segments than this.
+		MaxSegments int
+		// Interval is how often retention is applied. It defaults to a minute.
+		Interval time.Duration
+	}
+	// Durability is when appended records are fsynced to disk.
+	Durability Durability
+}
+
+// SyncPolicy is when the log fsyncs the records appended to it.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves writing records to disk to the OS, so records appended shortly before a crash can be lost.
+	SyncNever SyncPolicy = iota
+	// SyncAlways fsyncs before an append returns, so every offset handed out survives a crash. Concurrent appends share an fsync.
+	SyncAlways
+	// SyncEvery fsyncs once Durability.Records records or Durability.Bytes bytes were appended since the last fsync.
+	SyncEvery
+	// SyncInterval fsyncs in the background every Durability.Interval.
+	SyncInterval
+)
+
+type Durability struct {
+	// Sync is when appended records are fsynced. It defaults to SyncNever.
+	Sync SyncPolicy
+	// Records is how many records SyncEvery appends before it fsyncs.
+	Records uint64
+	// Bytes is how many bytes SyncEvery appends before it fsyncs.
+	Bytes uint64
+	// Interval is how often SyncInterval fsyncs. It defaults to a second.
+	Interval time.Duration
 }
@@ -0,0 +1,615 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+/**
+ * DistributedLog replicates a Log across a cluster of servers using Raft.
+ * Appends go through the Raft leader and only return once a quorum of servers has committed the record.
+ */
+type DistributedLog struct {
+	config Config
+	log    *Log
+	raft   *raft.Raft
+}
+
+func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
+	l := &DistributedLog{
+		config: config,
+	}
+	if err := l.setupLog(dataDir); err != nil {
+		return nil, err
+	}
+	if err := l.setupRaft(dataDir); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *DistributedLog) setupLog(dataDir string) error {
+	logDir := filepath.Join(dataDir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	var err error
+	l.log, err = NewLog(logDir, l.config)
+	return err
+}
+
+func (l *DistributedLog) setupRaft(dataDir string) error {
+	// The finite state machine applies committed commands to our local log.
+	fsm := &fsm{log: l.log}
+
+	// Raft keeps its own log of commands, which we store in one of our logs as well.
+	logDir := filepath.Join(dataDir, "raft", "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	logConfig := l.config
+	// Raft expects the first log entry to have an index of 1.
+	logConfig.Segment.InitialOffset = 1
+	logStore, err := newLogStore(logDir, logConfig)
+	if err != nil {
+		return err
+	}
+
+	// The stable store keeps the server's current term and the candidate it voted for.
+	stableStore, err := raftboltdb.NewBoltStore(filepath.Join(dataDir, "raft", "stable"))
+	if err != nil {
+		return err
+	}
+
+	// We only keep the latest snapshot around, which is enough to restore from.
+	retain := 1
+	snapshotStore, err := raft.NewFileSnapshotStore(filepath.Join(dataDir, "raft"), retain, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	maxPool := 5
+	timeout := 10 * time.Second
+	transport := raft.NewNetworkTransport(l.config.Raft.StreamLayer, maxPool, timeout, os.Stderr)
+
+	config := raftConfig(l.config.Raft.Config)
+	l.raft, err = raft.NewRaft(config, fsm, logStore, stableStore, snapshotStore, transport)
+	if err != nil {
+		return err
+	}
+	hasState, err := raft.HasExistingState(logStore, stableStore, snapshotStore)
+	if err != nil {
+		return err
+	}
+	// Only bootstrap a brand new cluster, restarting servers recover their configuration from their state.
+	if l.config.Raft.Bootstrap && !hasState {
+		config := raft.Configuration{
+			Servers: []raft.Server{{
+				ID:      config.LocalID,
+				Address: transport.LocalAddr(),
+			}},
+		}
+		err = l.raft.BootstrapCluster(config).Error()
+	}
+	return err
+}
+
+// raftConfig fills in Raft's defaults for the fields the config leaves unset, e.g. so tests can run a fast cluster by only setting the timeouts.
+// A zero ShutdownOnRemove can't be told apart from an unset one, so it's always on like Raft's default.
+func raftConfig(c raft.Config) *raft.Config {
+	defaults := raft.DefaultConfig()
+	orDefault(&c.ProtocolVersion, defaults.ProtocolVersion)
+	orDefault(&c.HeartbeatTimeout, defaults.HeartbeatTimeout)
+	orDefault(&c.ElectionTimeout, defaults.ElectionTimeout)
+	orDefault(&c.CommitTimeout, defaults.CommitTimeout)
+	orDefault(&c.MaxAppendEntries, defaults.MaxAppendEntries)
+	orDefault(&c.ShutdownOnRemove, defaults.ShutdownOnRemove)
+	orDefault(&c.TrailingLogs, defaults.TrailingLogs)
+	orDefault(&c.SnapshotInterval, defaults.SnapshotInterval)
+	orDefault(&c.SnapshotThreshold, defaults.SnapshotThreshold)
+	orDefault(&c.LeaderLeaseTimeout, defaults.LeaderLeaseTimeout)
+	orDefault(&c.LogLevel, defaults.LogLevel)
+	return &c
+}
+
+func orDefault[T comparable](v *T, def T) {
+	var zero T
+	if *v == zero {
+		*v = def
+	}
+}
+
+// Append replicates the record through Raft and returns its offset once a quorum has committed it.
+func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	stamp(record)
+	res, err := l.apply(AppendRequestType, &api.ProduceRequest{Record: record})
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.ProduceResponse).Offset, nil
+}
+
+// AppendAt replicates the record through Raft, and it's only appended if it gets the expected offset.
+// The offset is checked when the command is applied, as the log's next offset can change between now and then.
+func (l *DistributedLog) AppendAt(record *api.Record, expected uint64) (uint64, error) {
+	stamp(record)
+	res, err := l.apply(AppendRequestType, &api.ProduceRequest{Record: record, ExpectedOffset: &expected})
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.ProduceResponse).Offset, nil
+}
+
+// AppendBatch replicates the records as a single Raft command, so they are appended together on every server.
+func (l *DistributedLog) AppendBatch(records []*api.Record) (uint64, error) {
+	stamp(records...)
+	// The batch is compressed with the log's codec before it goes through Raft, which saves replicating it uncompressed.
+	batch, err := api.NewRecordBatch(l.config.Segment.Codec, records)
+	if err != nil {
+		return 0, err
+	}
+	res, err := l.apply(AppendBatchRequestType, &api.ProduceBatchRequest{Batch: batch})
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.ProduceBatchResponse).BaseOffset, nil
+}
+
+func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (interface{}, error) {
+	var buf bytes.Buffer
+	// The first byte of every command tells the FSM what kind of request it is.
+	if _, err := buf.Write([]byte{byte(reqType)}); err != nil {
+		return nil, err
+	}
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = buf.Write(b); err != nil {
+		return nil, err
+	}
+	timeout := 10 * time.Second
+	future := l.raft.Apply(buf.Bytes(), timeout)
+	if future.Error() != nil {
+		return nil, future.Error()
+	}
+	res := future.Response()
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Read reads from the local log, which may lag behind the leader for records that haven't been replicated yet.
+func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
+	return l.log.Read(offset)
+}
+
+// OffsetForTime looks the time up in the local log, like Read.
+func (l *DistributedLog) OffsetForTime(t time.Time) (uint64, error) {
+	return l.log.OffsetForTime(t)
+}
+
+// Wait blocks until there is a record at or after the offset in the local log, or the context is done. Followers are woken as records are replicated to them.
+func (l *DistributedLog) Wait(ctx context.Context, offset uint64) error {
+	return l.log.Wait(ctx, offset)
+}
+
+// ReadCommitted reads from the local log like Read, skipping markers and aborted records.
+func (l *DistributedLog) ReadCommitted(offset uint64) (*api.Record, error) {
+	return l.log.ReadCommitted(offset)
+}
+
+// WaitCommitted blocks until ReadCommitted has a record at or after the offset in the local log, or the context is done.
+func (l *DistributedLog) WaitCommitted(ctx context.Context, offset uint64) error {
+	return l.log.WaitCommitted(ctx, offset)
+}
+
+// LowestOffset returns the lowest offset in the local log.
+func (l *DistributedLog) LowestOffset() (uint64, error) {
+	return l.log.LowestOffset()
+}
+
+// HighestOffset returns the highest offset in the local log.
+func (l *DistributedLog) HighestOffset() (uint64, error) {
+	return l.log.HighestOffset()
+}
+
+// LastStableOffset returns the local log's last stable offset.
+func (l *DistributedLog) LastStableOffset() uint64 {
+	return l.log.LastStableOffset()
+}
+
+// OpenTransactions returns the transactions open in the local log.
+func (l *DistributedLog) OpenTransactions() []uint64 {
+	return l.log.OpenTransactions()
+}
+
+// Join adds the server to the cluster as a voter. It's a no-op if the server is already a member.
+func (l *DistributedLog) Join(id, addr string) error {
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	serverID := raft.ServerID(id)
+	serverAddr := raft.ServerAddress(addr)
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == serverID || srv.Address == serverAddr {
+			if srv.ID == serverID && srv.Address == serverAddr {
+				// The server has already joined
+				return nil
+			}
+			// Remove the existing server so it can rejoin with its new ID or address.
+			removeFuture := l.raft.RemoveServer(srv.ID, 0, 0)
+			if err := removeFuture.Error(); err != nil {
+				return err
+			}
+		}
+	}
+	addFuture := l.raft.AddVoter(serverID, serverAddr, 0, 0)
+	return addFuture.Error()
+}
+
+// Leave removes the server from the cluster.
+func (l *DistributedLog) Leave(id string) error {
+	removeFuture := l.raft.RemoveServer(raft.ServerID(id), 0, 0)
+	return removeFuture.Error()
+}
+
+// GetServers returns the servers in the cluster and which of them is the leader.
+func (l *DistributedLog) GetServers() ([]*api.Server, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	leaderAddr, _ := l.raft.LeaderWithID()
+	var servers []*api.Server
+	for _, server := range future.Configuration().Servers {
+		servers = append(servers, &api.Server{
+			Id:       string(server.ID),
+			RpcAddr:  string(server.Address),
+			IsLeader: leaderAddr == server.Address,
+		})
+	}
+	return servers, nil
+}
+
+// CheckLeader returns an ErrNotLeader with the leader's address unless this server is the leader.
+func (l *DistributedLog) CheckLeader() error {
+	if l.raft.State() == raft.Leader {
+		return nil
+	}
+	leaderAddr, _ := l.raft.LeaderWithID()
+	return api.ErrNotLeader{Leader: string(leaderAddr)}
+}
+
+// WaitForLeader blocks until the cluster has elected a leader or the timeout expires.
+func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(time.Second / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out waiting for a leader")
+		case <-ticker.C:
+			if addr, _ := l.raft.LeaderWithID(); addr != "" {
+				return nil
+			}
+		}
+	}
+}
+
+func (l *DistributedLog) Close() error {
+	f := l.raft.Shutdown()
+	if err := f.Error(); err != nil {
+		return err
+	}
+	return l.log.Close()
+}
+
+var _ raft.FSM = (*fsm)(nil)
+
+type fsm struct {
+	log *Log
+}
+
+type RequestType uint8
+
+const (
+	AppendRequestType      RequestType = 0
+	AppendBatchRequestType RequestType = 1
+)
+
+func (f *fsm) Apply(record *raft.Log) interface{} {
+	buf := record.Data
+	reqType := RequestType(buf[0])
+	switch reqType {
+	case AppendRequestType:
+		return f.applyAppend(buf[1:])
+	case AppendBatchRequestType:
+		return f.applyAppendBatch(buf[1:])
+	}
+	return nil
+}
+
+func (f *fsm) applyAppend(b []byte) interface{} {
+	var req api.ProduceRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	var offset uint64
+	var err error
+	if req.ExpectedOffset != nil {
+		offset, err = f.log.AppendAt(req.Record, *req.ExpectedOffset)
+	} else {
+		offset, err = f.log.Append(req.Record)
+	}
+	if err != nil {
+		return err
+	}
+	return &api.ProduceResponse{Offset: offset}
+}
+
+func (f *fsm) applyAppendBatch(b []byte) interface{} {
+	var req api.ProduceBatchRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	records, err := req.Batch.Decode()
+	if err != nil {
+		return err
+	}
+	offset, err := f.log.AppendBatch(records)
+	if err != nil {
+		return err
+	}
+	return &api.ProduceBatchResponse{
+		BaseOffset: offset,
+		LastOffset: offset + uint64(len(records)) - 1,
+	}
+}
+
+// snapshotHeaderWidth is the size of the header a snapshot starts with: the log's lowest offset followed by its next offset.
+// Compaction can leave gaps at either end of the records, so a snapshot needs them to restore a log with the same offsets.
+const snapshotHeaderWidth = 16
+
+// Snapshot returns a point-in-time snapshot of the log, which Raft uses to bring new or lagging servers up to date.
+// Raft persists it while it carries on applying commands, so the snapshot stops at the records the log had when it was taken. Otherwise Raft would apply the later ones again on top of it when it's restored.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	lowest, next, r := f.log.pointInTime()
+	header := make([]byte, snapshotHeaderWidth)
+	enc.PutUint64(header[:8], lowest)
+	enc.PutUint64(header[8:], next)
+	return &snapshot{reader: io.MultiReader(bytes.NewReader(header), r)}, nil
+}
+
+// Restore replaces the log with the records in the snapshot, which keep the offsets they have on the rest of the cluster.
+func (f *fsm) Restore(r io.ReadCloser) error {
+	header := make([]byte, snapshotHeaderWidth)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	lowest, next := enc.Uint64(header[:8]), enc.Uint64(header[8:])
+	return f.log.replace(lowest, next, func(write func([]*api.Record) error) error {
+		for {
+			p, err := readStoreFrame(r)
+			if errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			// A frame holds either a single record or a compressed batch of them.
+			records, err := decodeFrame(p)
+			if err != nil {
+				return err
+			}
+			if err = write(records); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+var _ raft.FSMSnapshot = (*snapshot)(nil)
+
+type snapshot struct {
+	reader io.Reader
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := io.Copy(sink, s.reader); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
+
+var (
+	_ raft.LogStore          = (*logStore)(nil)
+	_ raft.MonotonicLogStore = (*logStore)(nil)
+)
+
+/**
+ * logStore lets Raft store its own log entries in one of our logs.
+ * Raft log indexes map directly onto record offsets.
+ */
+type logStore struct {
+	*Log
+}
+
+func newLogStore(dir string, c Config) (*logStore, error) {
+	log, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	return &logStore{log}, nil
+}
+
+func (l *logStore) FirstIndex() (uint64, error) {
+	return l.LowestOffset()
+}
+
+func (l *logStore) LastIndex() (uint64, error) {
+	return l.HighestOffset()
+}
+
+func (l *logStore) GetLog(index uint64, out *raft.Log) error {
+	in, err := l.Read(index)
+	// Entries compacted away after a snapshot are out of range, and Raft only sends a follower the snapshot when it gets ErrLogNotFound.
+	if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+		return raft.ErrLogNotFound
+	}
+	if err != nil {
+		return err
+	}
+	// Read returns the next record if the index is missing, but Raft needs to know the entry isn't there.
+	if in.Offset != index {
+		return raft.ErrLogNotFound
+	}
+	out.Data = in.Value
+	out.Index = in.Offset
+	out.Type = raft.LogType(in.Type)
+	out.Term = in.Term
+	return nil
+}
+
+func (l *logStore) StoreLog(record *raft.Log) error {
+	return l.StoreLogs([]*raft.Log{record})
+}
+
+// StoreLogs appends the entries as one batch, so with SyncAlways they share a single fsync before Raft counts them as stored.
+// Each entry has to land at the offset matching its index, which GetLog relies on to find it.
+// Entries that wouldn't land at their index are rejected before anything is written, rather than leaving Raft's indexes and our offsets silently out of step.
+func (l *logStore) StoreLogs(records []*raft.Log) error {
+	if len(records) == 0 {
+		return nil
+	}
+	next := l.nextOffset()
+	// After installing a snapshot Raft removes every entry, and the leader carries on from the entry after the snapshot.
+	// An empty log can start anywhere, so we move it up to that entry.
+	if lowest, err := l.LowestOffset(); err != nil {
+		return err
+	} else if first := records[0].Index; lowest == next && first > next {
+		if err = l.Truncate(first - 1); err != nil {
+			return err
+		}
+		next = first
+	}
+	batch := make([]*api.Record, len(records))
+	for i, record := range records {
+		if expected := next + uint64(i); record.Index != expected {
+			return api.ErrOffsetMismatch{Expected: record.Index, Actual: expected}
+		}
+		batch[i] = &api.Record{
+			Value: record.Data,
+			Term:  record.Term,
+			Type:  uint32(record.Type),
+		}
+	}
+	// Raft is the only writer, so the offsets can't have moved since we checked, but we make sure.
+	first, err := l.AppendBatch(batch)
+	if err != nil {
+		return err
+	}
+	if first != next {
+		return api.ErrOffsetMismatch{Expected: next, Actual: first}
+	}
+	return nil
+}
+
+// IsMonotonic tells Raft our indexes have to be consecutive. So once it has installed a snapshot it removes every entry, rather than keeping some from before the snapshot that the entries after it couldn't follow.
+func (l *logStore) IsMonotonic() bool {
+	return true
+}
+
+// DeleteRange is called by Raft both to compact old entries after a snapshot and to drop conflicting entries from the tail of the log.
+func (l *logStore) DeleteRange(min, max uint64) error {
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	if min > lowest {
+		return l.truncateFrom(min)
+	}
+	return l.Truncate(max)
+}
+
+var _ raft.StreamLayer = (*StreamLayer)(nil)
+
+// RaftRPC is the first byte written on every Raft connection, so Raft traffic can share a listener with other protocols.
+const RaftRPC = 1
+
+/**
+ * StreamLayer is the Raft transport between servers, optionally encrypted with TLS.
+ */
+type StreamLayer struct {
+	ln              net.Listener
+	serverTLSConfig *tls.Config
+	peerTLSConfig   *tls.Config
+}
+
+func NewStreamLayer(ln net.Listener, serverTLSConfig, peerTLSConfig *tls.Config) *StreamLayer {
+	return &StreamLayer{
+		ln:              ln,
+		serverTLSConfig: serverTLSConfig,
+		peerTLSConfig:   peerTLSConfig,
+	}
+}
+
+func (s *StreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("tcp", string(addr))
+	if err != nil {
+		return nil, err
+	}
+	// Identify the connection as a Raft RPC before any TLS handshake.
+	if _, err = conn.Write([]byte{byte(RaftRPC)}); err != nil {
+		return nil, err
+	}
+	if s.peerTLSConfig != nil {
+		conn = tls.Client(conn, s.peerTLSConfig)
+	}
+	return conn, nil
+}
+
+func (s *StreamLayer) Accept() (net.Conn, error) {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 1)
+	if _, err = conn.Read(b); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal([]byte{byte(RaftRPC)}, b) {
+		return nil, fmt.Errorf("not a raft rpc")
+	}
+	if s.serverTLSConfig != nil {
+		return tls.Server(conn, s.serverTLSConfig), nil
+	}
+	return conn, nil
+}
+
+func (s *StreamLayer) Close() error {
+	return s.ln.Close()
+}
+
+func (s *StreamLayer) Addr() net.Addr {
+	return s.ln.Addr()
+}
@@ -0,0 +1,366 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultipleNodes(t *testing.T) {
+	var logs []*DistributedLog
+	nodeCount := 3
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := os.MkdirTemp(os.TempDir(), "distributed_log_test")
+		require.NoError(t, err)
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dataDir)
+
+		// Each node gets its own loopback listener on a random port.
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+
+		// The first node bootstraps the cluster and becomes the leader.
+		if i == 0 {
+			config.Raft.Bootstrap = true
+		}
+
+		l, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer l.Close()
+
+		if i != 0 {
+			err = logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String())
+			require.NoError(t, err)
+		} else {
+			err = l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+
+		logs = append(logs, l)
+	}
+
+	records := []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	}
+	for _, record := range records {
+		off, err := logs[0].Append(record)
+		require.NoError(t, err)
+		// Every follower should eventually catch up with the leader.
+		require.Eventually(t, func() bool {
+			for j := 0; j < nodeCount; j++ {
+				got, err := logs[j].Read(off)
+				if err != nil {
+					return false
+				}
+				record.Offset = off
+				// The leader stamps the record before replicating it, so every server has the same timestamp.
+				if !reflect.DeepEqual(got.Value, record.Value) || got.Timestamp != record.Timestamp {
+					return false
+				}
+			}
+			return true
+		}, 500*time.Millisecond, 50*time.Millisecond)
+	}
+
+	// A batch is replicated as a single command and gets consecutive offsets on every node.
+	batch := []*api.Record{{Value: []byte("batch 1")}, {Value: []byte("batch 2")}}
+	base, err := logs[0].AppendBatch(batch)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		for j := 0; j < nodeCount; j++ {
+			for i, want := range batch {
+				got, err := logs[j].Read(base + uint64(i))
+				if err != nil || !reflect.DeepEqual(got.Value, want.Value) {
+					return false
+				}
+			}
+		}
+		return true
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	servers, err := logs[0].GetServers()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(servers))
+	require.True(t, servers[0].IsLeader)
+	require.False(t, servers[1].IsLeader)
+	require.False(t, servers[2].IsLeader)
+
+	// Once a node leaves the cluster it should no longer receive new records.
+	err = logs[0].Leave("1")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		servers, err = logs[0].GetServers()
+		return err == nil && len(servers) == 2
+	}, 500*time.Millisecond, 50*time.Millisecond)
+	require.True(t, servers[0].IsLeader)
+	require.False(t, servers[1].IsLeader)
+
+	off, err := logs[0].Append(&api.Record{
+		Value: []byte("third"),
+	})
+	require.NoError(t, err)
+
+	// The remaining follower gets the record, by which time the node that left would have too if it were still replicated to.
+	var record *api.Record
+	require.Eventually(t, func() bool {
+		record, err = logs[2].Read(off)
+		return err == nil
+	}, 500*time.Millisecond, 50*time.Millisecond)
+	require.Equal(t, []byte("third"), record.Value)
+	require.Equal(t, off, record.Offset)
+
+	record, err = logs[1].Read(off)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	require.Nil(t, record)
+}
+
+func TestSnapshotInstall(t *testing.T) {
+	leader, _ := setupDistributedLog(t, 0)
+	for i := 0; i < 5; i++ {
+		_, err := leader.Append(&api.Record{Value: []byte(fmt.Sprintf("before %d", i))})
+		require.NoError(t, err)
+	}
+	// The leader only keeps the last entry after a snapshot, so a new server has to be sent the snapshot.
+	require.NoError(t, leader.raft.Snapshot().Error())
+
+	follower, addr := setupDistributedLog(t, 1)
+	require.NoError(t, leader.Join("1", addr))
+	// The append only commits once the follower stores it, so it runs on its own to let the test fail rather than hang.
+	appended := make(chan error, 1)
+	go func() {
+		_, err := leader.Append(&api.Record{Value: []byte("after")})
+		appended <- err
+	}()
+	require.Eventually(t, func() bool {
+		record, err := follower.Read(5)
+		return err == nil && string(record.Value) == "after"
+	}, 3*time.Second, 50*time.Millisecond)
+	require.NoError(t, <-appended)
+	for i := uint64(0); i < 5; i++ {
+		record, err := follower.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("before %d", i), string(record.Value))
+	}
+}
+
+// setupDistributedLog starts a server of a fast cluster that only keeps one entry after a snapshot. The first one bootstraps the cluster.
+// Raft's entries are removed a segment at a time, so every entry gets a segment of its own.
+func setupDistributedLog(t *testing.T, id int) (*DistributedLog, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	config := Config{}
+	config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", id))
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.TrailingLogs = 1
+	config.Segment.MaxStoreBytes = 1
+	config.Raft.Bootstrap = id == 0
+	l, err := NewDistributedLog(t.TempDir(), config)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	if id == 0 {
+		require.NoError(t, l.WaitForLeader(3*time.Second))
+	}
+	return l, ln.Addr().String()
+}
+
+func TestLogStoreDeleteRange(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "log_store_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.InitialOffset = 1
+	ls, err := newLogStore(dir, c)
+	require.NoError(t, err)
+
+	for i := uint64(1); i <= 5; i++ {
+		require.NoError(t, ls.StoreLog(&raft.Log{Index: i, Term: 1, Data: []byte("entry")}))
+	}
+
+	// Dropping a conflicting tail lets Raft overwrite those entries.
+	require.NoError(t, ls.DeleteRange(4, 5))
+	last, err := ls.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), last)
+
+	require.NoError(t, ls.StoreLog(&raft.Log{Index: 4, Term: 2, Data: []byte("replaced")}))
+	var out raft.Log
+	require.NoError(t, ls.GetLog(4, &out))
+	require.Equal(t, uint64(2), out.Term)
+	require.Equal(t, []byte("replaced"), out.Data)
+
+	// An entry that wouldn't land at its index is rejected without being written.
+	err = ls.StoreLogs([]*raft.Log{{Index: 5, Term: 2}, {Index: 7, Term: 2}})
+	require.Equal(t, api.ErrOffsetMismatch{Expected: 7, Actual: 6}, err)
+	last, err = ls.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), last)
+}
+
+func TestFSMRestoreKeepsTimestamps(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	src, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer src.Close()
+	for i := int64(1); i <= 3; i++ {
+		_, err = src.Append(&api.Record{Value: []byte("hello world"), Timestamp: i})
+		require.NoError(t, err)
+	}
+
+	dst, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer dst.Close()
+	f := &fsm{log: dst}
+	require.NoError(t, f.Restore(snapshotLog(t, src)))
+	// A follower restored from a snapshot has the leader's timestamps, not the time it was restored at.
+	for i := int64(1); i <= 3; i++ {
+		record, err := dst.Read(uint64(i - 1))
+		require.NoError(t, err)
+		require.Equal(t, i, record.Timestamp)
+	}
+}
+
+func TestFSMRestore(t *testing.T) {
+	c := Config{}
+	// Every record gets a segment of its own, so compaction can empty whole segments.
+	c.Segment.MaxStoreBytes = 1
+	src, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer src.Close()
+	for _, record := range []*api.Record{
+		{Key: []byte("a"), Value: []byte("old")},
+		{Key: []byte("b"), Value: []byte("kept")},
+		{Key: []byte("a"), Value: []byte("new")},
+		// A tombstone is dropped along with its segment once it expires, which leaves a gap at the end of the records.
+		{Key: []byte("c")},
+	} {
+		_, err = src.Append(record)
+		require.NoError(t, err)
+	}
+	require.NoError(t, src.Compact())
+
+	dst, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer dst.Close()
+	for i := 0; i < 10; i++ {
+		_, err = dst.Append(&api.Record{Value: []byte("replaced")})
+		require.NoError(t, err)
+	}
+	f := &fsm{log: dst}
+	require.NoError(t, f.Restore(snapshotLog(t, src)))
+
+	// The records keep their offsets and the gaps compaction left around them.
+	for off, want := range []string{"kept", "kept", "new"} {
+		record, err := dst.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, want, string(record.Value))
+	}
+	_, err = dst.Read(3)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	off, err := dst.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	// An empty snapshot still replaces what was there.
+	empty, err := NewLog(t.TempDir(), Config{})
+	require.NoError(t, err)
+	defer empty.Close()
+	require.NoError(t, f.Restore(snapshotLog(t, empty)))
+	_, err = dst.Read(0)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	off, err = dst.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+func TestFSMSnapshotIsPointInTime(t *testing.T) {
+	src, err := NewLog(t.TempDir(), Config{})
+	require.NoError(t, err)
+	defer src.Close()
+	_, err = src.Append(&api.Record{Value: []byte("before")})
+	require.NoError(t, err)
+	snap, err := (&fsm{log: src}).Snapshot()
+	require.NoError(t, err)
+	// Raft keeps applying commands while it persists the snapshot, and those mustn't end up in it.
+	_, err = src.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	sink := &bufferSink{}
+	require.NoError(t, snap.Persist(sink))
+
+	dst, err := NewLog(t.TempDir(), Config{})
+	require.NoError(t, err)
+	defer dst.Close()
+	require.NoError(t, (&fsm{log: dst}).Restore(io.NopCloser(&sink.Buffer)))
+	record, err := dst.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("before"), record.Value)
+	_, err = dst.Read(1)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+// snapshotLog persists a snapshot of the log the way Raft does, so it can be restored.
+func snapshotLog(t *testing.T, l *Log) io.ReadCloser {
+	t.Helper()
+	snap, err := (&fsm{log: l}).Snapshot()
+	require.NoError(t, err)
+	sink := &bufferSink{}
+	require.NoError(t, snap.Persist(sink))
+	snap.Release()
+	return io.NopCloser(&sink.Buffer)
+}
+
+// bufferSink implements raft.SnapshotSink in memory.
+type bufferSink struct {
+	bytes.Buffer
+}
+
+func (s *bufferSink) ID() string    { return "test" }
+func (s *bufferSink) Cancel() error { return nil }
+func (s *bufferSink) Close() error  { return nil }
+
+func TestRaftConfig(t *testing.T) {
+	c := raft.Config{
+		LocalID:           "0",
+		HeartbeatTimeout:  50 * time.Millisecond,
+		TrailingLogs:      5,
+		SnapshotThreshold: 10,
+	}
+	got := raftConfig(c)
+	// The fields we set are kept, whichever they are, and the rest get Raft's defaults.
+	require.Equal(t, raft.ServerID("0"), got.LocalID)
+	require.Equal(t, 50*time.Millisecond, got.HeartbeatTimeout)
+	require.Equal(t, uint64(5), got.TrailingLogs)
+	require.Equal(t, uint64(10), got.SnapshotThreshold)
+	require.Equal(t, raft.DefaultConfig().ElectionTimeout, got.ElectionTimeout)
+	require.Equal(t, raft.DefaultConfig().SnapshotInterval, got.SnapshotInterval)
+	require.True(t, got.ShutdownOnRemove)
+}
@@ -0,0 +1,97 @@
+package log
+
+import (
+	"sync"
+)
+
+/**
+ * syncState is the log's group commit state. Only one append fsyncs at a time, and every append that waits for it
+ * is covered by the next fsync, so concurrent producers share fsyncs rather than queueing one each.
+ * The lock is never held while taking the log's lock, so it can be taken under it.
+ */
+type syncState struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// syncing is set while an append is fsyncing for everyone waiting.
+	syncing bool
+	// synced is the offset every record before has been fsynced, and syncedBytes how many bytes had been appended by then.
+	synced      uint64
+	syncedBytes uint64
+	// syncs counts the fsyncs, which shows how many appends shared each one.
+	syncs uint64
+}
+
+func newSyncState(synced uint64) *syncState {
+	s := &syncState{synced: synced}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Sync fsyncs every record appended to the log so far.
+func (l *Log) Sync() error {
+	l.mu.RLock()
+	next := l.activeSegment.nextOffset
+	l.mu.RUnlock()
+	return l.syncThrough(next)
+}
+
+// afterAppend applies the durability policy once records up to the offset were appended.
+// With SyncAlways it only returns once they were fsynced, so the offsets handed to producers are durable.
+func (l *Log) afterAppend(next uint64) error {
+	switch d := l.Config.Durability; d.Sync {
+	case SyncAlways:
+		return l.syncThrough(next)
+	case SyncEvery:
+		l.durable.mu.Lock()
+		due := (d.Records > 0 && next-min(next, l.durable.synced) >= d.Records) ||
+			(d.Bytes > 0 && l.written.Load()-l.durable.syncedBytes >= d.Bytes)
+		l.durable.mu.Unlock()
+		if due {
+			return l.syncThrough(next)
+		}
+	}
+	return nil
+}
+
+// syncThrough waits until every record before the offset was fsynced. If no one else is fsyncing, the caller does it for everyone that appended so far.
+func (l *Log) syncThrough(next uint64) error {
+	s := l.durable
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.synced < next {
+		if s.syncing {
+			s.cond.Wait()
+			continue
+		}
+		s.syncing = true
+		s.mu.Unlock()
+		synced, written, err := l.syncActive()
+		s.mu.Lock()
+		s.syncing = false
+		s.syncs++
+		// Wake the waiters either way, if the fsync failed one of them tries again.
+		s.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+		s.synced = max(s.synced, synced)
+		s.syncedBytes = max(s.syncedBytes, written)
+	}
+	return nil
+}
+
+// syncActive fsyncs the active segment and returns the offset and byte count it covers. The segments before it were fsynced when they were rolled.
+// We hold the read lock so the segment isn't closed or swapped out during the fsync, appends wait and are covered by the next one.
+func (l *Log) syncActive() (uint64, uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	next, written := l.activeSegment.nextOffset, l.written.Load()
+	return next, written, l.activeSegment.store.Sync()
+}
+
+// resetSynced lowers the synced offset after the log was truncated, so the records appended in place of the removed ones are fsynced again.
+func (l *Log) resetSynced(next uint64) {
+	l.durable.mu.Lock()
+	defer l.durable.mu.Unlock()
+	l.durable.synced = min(l.durable.synced, next)
+}
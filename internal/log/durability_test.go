@@ -0,0 +1,187 @@
+package log
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurability(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, c Config, dir string,
+	){
+		"never leaves syncing to the os":     testSyncNever,
+		"always syncs before returning":      testSyncAlways,
+		"concurrent appends share syncs":     testSyncGroupCommit,
+		"every n records":                    testSyncEveryRecords,
+		"every n bytes":                      testSyncEveryBytes,
+		"on an interval":                     testSyncInterval,
+		"rolled segments are synced":         testSyncRolled,
+		"truncated records are synced again": testSyncTruncated,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp(os.TempDir(), "durability_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			fn(t, c, dir)
+		})
+	}
+}
+
+func newDurableLog(t *testing.T, c Config, dir string) *Log {
+	t.Helper()
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	t.Cleanup(func() { log.Close() })
+	return log
+}
+
+// synced returns the offset every record before has been fsynced and how many fsyncs it took.
+func synced(log *Log) (uint64, uint64) {
+	log.durable.mu.Lock()
+	defer log.durable.mu.Unlock()
+	return log.durable.synced, log.durable.syncs
+}
+
+func appendValue(t *testing.T, log *Log) uint64 {
+	t.Helper()
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	return off
+}
+
+func testSyncNever(t *testing.T, c Config, dir string) {
+	log := newDurableLog(t, c, dir)
+	appendValue(t, log)
+	off, syncs := synced(log)
+	require.Equal(t, uint64(0), off)
+	require.Equal(t, uint64(0), syncs)
+
+	// Syncing can still be asked for explicitly.
+	require.NoError(t, log.Sync())
+	off, _ = synced(log)
+	require.Equal(t, uint64(1), off)
+}
+
+func testSyncAlways(t *testing.T, c Config, dir string) {
+	c.Durability.Sync = SyncAlways
+	log := newDurableLog(t, c, dir)
+	for i := uint64(0); i < 3; i++ {
+		off := appendValue(t, log)
+		s, _ := synced(log)
+		require.Equal(t, off+1, s)
+	}
+	first, err := log.AppendBatch([]*api.Record{{Value: []byte("a")}, {Value: []byte("b")}})
+	require.NoError(t, err)
+	s, _ := synced(log)
+	require.Equal(t, first+2, s)
+}
+
+func testSyncGroupCommit(t *testing.T, c Config, dir string) {
+	c.Durability.Sync = SyncAlways
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	log := newDurableLog(t, c, dir)
+
+	// Hold off the fsync until every producer has appended, as if they all arrived while one was in progress.
+	log.durable.mu.Lock()
+	log.durable.syncing = true
+	log.durable.mu.Unlock()
+
+	producers := 50
+	var wg sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			appendValue(t, log)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		next, _ := log.HighestOffset()
+		return next == uint64(producers-1)
+	}, time.Second, time.Millisecond)
+
+	log.durable.mu.Lock()
+	log.durable.syncing = false
+	log.durable.cond.Broadcast()
+	log.durable.mu.Unlock()
+	wg.Wait()
+
+	off, syncs := synced(log)
+	require.Equal(t, uint64(producers), off)
+	// The first producer to wake up fsyncs for everyone.
+	require.Equal(t, uint64(1), syncs)
+}
+
+func testSyncEveryRecords(t *testing.T, c Config, dir string) {
+	c.Durability.Sync = SyncEvery
+	c.Durability.Records = 3
+	log := newDurableLog(t, c, dir)
+	appendValue(t, log)
+	appendValue(t, log)
+	off, _ := synced(log)
+	require.Equal(t, uint64(0), off)
+	appendValue(t, log)
+	off, _ = synced(log)
+	require.Equal(t, uint64(3), off)
+}
+
+func testSyncEveryBytes(t *testing.T, c Config, dir string) {
+	c.Durability.Sync = SyncEvery
+	c.Durability.Bytes = 50
+	log := newDurableLog(t, c, dir)
+	for off := uint64(0); ; off++ {
+		appendValue(t, log)
+		if log.written.Load() >= c.Durability.Bytes {
+			s, _ := synced(log)
+			require.Equal(t, off+1, s)
+			return
+		}
+		s, _ := synced(log)
+		require.Equal(t, uint64(0), s)
+	}
+}
+
+func testSyncInterval(t *testing.T, c Config, dir string) {
+	c.Durability.Sync = SyncInterval
+	c.Durability.Interval = 10 * time.Millisecond
+	log := newDurableLog(t, c, dir)
+	appendValue(t, log)
+	require.Eventually(t, func() bool {
+		off, _ := synced(log)
+		return off == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func testSyncRolled(t *testing.T, c Config, dir string) {
+	c.Durability.Sync = SyncAlways
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log := newDurableLog(t, c, dir)
+	for i := 0; i < 5; i++ {
+		appendValue(t, log)
+	}
+	require.Len(t, log.segments, 3)
+	off, _ := synced(log)
+	require.Equal(t, uint64(5), off)
+}
+
+func testSyncTruncated(t *testing.T, c Config, dir string) {
+	c.Durability.Sync = SyncAlways
+	log := newDurableLog(t, c, dir)
+	for i := 0; i < 3; i++ {
+		appendValue(t, log)
+	}
+	require.NoError(t, log.truncateFrom(1))
+	off, _ := synced(log)
+	require.Equal(t, uint64(1), off)
+	require.Equal(t, uint64(1), appendValue(t, log))
+	off, _ = synced(log)
+	require.Equal(t, uint64(2), off)
+}
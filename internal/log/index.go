@@ -3,6 +3,8 @@ package log
 import (
 	"io"
 	"os"
+	"sort"
+	"sync/atomic"
 
 	"github.com/tysonmote/gommap"
 )
@@ -16,7 +18,8 @@ var (
 type index struct {
 	file *os.File
 	mmap gommap.MMap
-	size uint64
+	// size is loaded by readers that don't hold the log's lock, so Write only grows it once the entry it covers is written.
+	size atomic.Uint64
 }
 
 func newIndex(f *os.File, c Config) (*index, error) {
@@ -29,7 +32,7 @@ func newIndex(f *os.File, c Config) (*index, error) {
 		return nil, err
 	}
 	// Store the size of the file in our index
-	idx.size = uint64(fi.Size())
+	idx.size.Store(uint64(fi.Size()))
 	// Truncate the file to the max index size (given in the config). The reason we do this now is because we cannot change the size of the file after it's been mapped into memory.
 	if err = os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
 		return nil, err
@@ -42,8 +45,8 @@ func newIndex(f *os.File, c Config) (*index, error) {
 }
 
 func (i *index) Close() error {
-	// Before closing the file, we need to flush the mmap to disk.
-	if err := i.mmap.Sync(gommap.MS_ASYNC); err != nil {
+	// Before closing the file, we need to flush the mmap to disk and wait for it to get there.
+	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
 		return err
 	}
 	// Before closing the file, we need to also flush any pending writes to disk.
@@ -51,20 +54,21 @@ func (i *index) Close() error {
 		return err
 	}
 	// Truncate the file size to the current size of the index
-	if err := i.file.Truncate(int64(i.size)); err != nil {
+	if err := i.file.Truncate(int64(i.size.Load())); err != nil {
 		return err
 	}
 	return i.file.Close()
 }
 
 func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
+	size := i.size.Load()
 	// If the index is empty, we return EOF.
-	if i.size == 0 {
+	if size == 0 {
 		return 0, 0, io.EOF
 	}
 	if in == -1 {
 		// If we are given -1, we return the last index entry.
-		out = uint32((i.size / entWidth) - 1)
+		out = uint32((size / entWidth) - 1)
 	} else {
 		// Otherwise, we store the index entry at the given position.
 		out = uint32(in)
@@ -72,7 +76,7 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	// Calculate the position of where to read the index entry from.
 	pos = uint64(out) * entWidth
 	// If the position is past the end of the file, we return EOF.
-	if i.size < pos+entWidth {
+	if size < pos+entWidth {
 		return 0, 0, io.EOF
 	}
 	// Read the index entry from the file.
@@ -82,17 +86,34 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 	return out, pos, nil
 }
 
+// Find returns the entry number, offset and position of the first index entry at or after the given relative offset.
+// Offsets are only sparse once a segment has been compacted, otherwise Read can look the entry up directly.
+func (i *index) Find(off uint32) (entry int64, out uint32, pos uint64, err error) {
+	entries := int(i.size.Load() / entWidth)
+	// Entries are sorted by offset, so we can binary search for the first one that isn't before the offset.
+	n := sort.Search(entries, func(e int) bool {
+		p := uint64(e) * entWidth
+		return enc.Uint32(i.mmap[p:p+offWidth]) >= off
+	})
+	if n == entries {
+		return 0, 0, 0, io.EOF
+	}
+	out, pos, err = i.Read(int64(n))
+	return int64(n), out, pos, err
+}
+
 func (i *index) Write(off uint32, pos uint64) error {
 	// If the memory mapped file is not large enough to hold the index entry, we return an error.
-	if uint64(len(i.mmap)) < i.size+entWidth {
+	size := i.size.Load()
+	if uint64(len(i.mmap)) < size+entWidth {
 		return io.EOF
 	}
 	// Write the offset to the index, placed at the end of the file plus 4 bytes for the offset.
-	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)
+	enc.PutUint32(i.mmap[size:size+offWidth], off)
 	// Write the position of the record to the index, placed at the end of the file plus 8 bytes for the position.
-	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
+	enc.PutUint64(i.mmap[size+offWidth:size+entWidth], pos)
 	// Update the size of the index
-	i.size += uint64(entWidth)
+	i.size.Store(size + entWidth)
 	return nil
 }
 
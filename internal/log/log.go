@@ -1,25 +1,49 @@
 package log
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"math"
 	"os"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	api "github.com/MartinMinkov/proglog/api/v1"
+	"go.uber.org/zap"
 )
 
 type Log struct {
 	mu sync.RWMutex
+	// compactMu is held while the cleaner rewrites sealed segments, so they are not removed from under it.
+	compactMu sync.Mutex
+	// done stops the background tasks, which background waits for on Close.
+	done       chan struct{}
+	background sync.WaitGroup
+	// closed is closed by Close and ends the subscriptions. Unlike done, it isn't replaced when the log is reset.
+	closed chan struct{}
+	// durable tracks what has been fsynced, and written is how many bytes were appended since the log was opened.
+	durable *syncState
+	written atomic.Uint64
+	// appended is closed and replaced whenever records are appended or truncated, which wakes everyone waiting for them.
+	appended      chan struct{}
+	subscriptions map[*Subscription]struct{}
+	// producers holds the latest sequences of the idempotent producers appending to the log.
+	producers    producers
+	transactions *transactions
 
 	Dir    string
 	Config Config
 
 	activeSegment *segment
 	segments      []*segment
+	// snapshot is a copy of segments that Read loads without the lock. Whatever changes segments publishes a new one while holding the write lock.
+	snapshot atomic.Pointer[[]*segment]
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -29,25 +53,170 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Compaction.Interval == 0 {
+		c.Compaction.Interval = time.Minute
+	}
+	if c.Retention.Interval == 0 {
+		c.Retention.Interval = time.Minute
+	}
+	if c.Durability.Interval == 0 {
+		c.Durability.Interval = time.Second
+	}
 	l := &Log{
 		Dir:    dir,
 		Config: c,
+		closed: make(chan struct{}),
 	}
 	return l, l.setup()
 }
 
 func (l *Log) setup() error {
+	l.mu.Lock()
+	err := l.open(l.Config.Segment.InitialOffset)
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	l.startBackground()
+	return nil
+}
+
+// open opens the segments in the directory, or starts a new one at the initial offset if there are none.
+// The segments are only swapped in once they're all open, so no one sees the log without any. The caller must hold the write lock.
+func (l *Log) open(initialOffset uint64) error {
 	// Create the directory for all the log files
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
 	files, err := os.ReadDir(l.Dir)
 	if err != nil {
 		return err
 	}
 
-	// We extract the segment offsets from the file names. This assums that the log files are named in the format {offset}.{ext}
+	// Finish or throw away any compaction that was interrupted before we look at the segments.
+	if err = recoverCleaned(l.Dir, files); err != nil {
+		return err
+	}
+	if files, err = os.ReadDir(l.Dir); err != nil {
+		return err
+	}
+
+	// Create the segments for each segment offset.
+	var segments []*segment
+	for _, off := range segmentBaseOffsets(files) {
+		s, err := newSegment(l.Dir, off, l.Config)
+		if err != nil {
+			return err
+		}
+		if r := s.recovery; r.repaired() {
+			zap.L().Named("log").Warn(
+				"recovered segment",
+				zap.String("dir", l.Dir),
+				zap.Uint64("segment", off),
+				zap.Int("dropped_entries", r.DroppedEntries),
+				zap.Int("rebuilt_entries", r.RebuiltEntries),
+				zap.Uint64("truncated_bytes", r.TruncatedBytes),
+			)
+		}
+		segments = append(segments, s)
+	}
+	if segments == nil {
+		s, err := newSegment(l.Dir, initialOffset, l.Config)
+		if err != nil {
+			return err
+		}
+		segments = append(segments, s)
+	}
+	// Stores created before they had a header aren't appended to, as a record that lost its checksummed bit could pass for one written before checksums in them.
+	if last := segments[len(segments)-1]; last.store.start == 0 && last.nextOffset > last.baseOffset {
+		s, err := newSegment(l.Dir, last.nextOffset, l.Config)
+		if err != nil {
+			return err
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	l.activeSegment = segments[len(segments)-1]
+	l.publish()
+	if err = l.loadState(); err != nil {
+		return err
+	}
+
+	// Anyone waiting on the log from before it was reset checks it again.
+	if l.appended != nil {
+		close(l.appended)
+	}
+	l.appended = make(chan struct{})
+	// The records that were already on disk when we opened the log count as synced.
+	// A reset log keeps its sync state, as appends might be waiting on it, and starts again from the first offset.
+	if l.durable == nil {
+		l.durable = newSyncState(l.activeSegment.nextOffset)
+	} else {
+		l.durable.mu.Lock()
+		l.durable.synced = l.segments[0].baseOffset
+		l.durable.mu.Unlock()
+	}
+	return nil
+}
+
+// startBackground starts the background tasks the config asks for, which stopBackground stops again.
+func (l *Log) startBackground() {
+	l.done = make(chan struct{})
+	if l.Config.Durability.Sync == SyncInterval {
+		l.every(l.Config.Durability.Interval, func(logger *zap.Logger) {
+			if err := l.Sync(); err != nil {
+				logger.Error("failed to sync log", zap.String("dir", l.Dir), zap.Error(err))
+			}
+		})
+	}
+	if l.Config.Compaction.Enabled {
+		l.every(l.Config.Compaction.Interval, func(logger *zap.Logger) {
+			if err := l.Compact(); err != nil {
+				logger.Error("failed to compact log", zap.String("dir", l.Dir), zap.Error(err))
+			}
+		})
+	}
+	if r := l.Config.Retention; r.MaxAge > 0 || r.MaxBytes > 0 || r.MaxSegments > 0 {
+		l.every(r.Interval, func(logger *zap.Logger) {
+			report, err := l.Retain()
+			if err != nil {
+				logger.Error("failed to apply retention", zap.String("dir", l.Dir), zap.Error(err))
+				return
+			}
+			if len(report.Segments) > 0 {
+				logger.Info(
+					"removed expired segments",
+					zap.String("dir", l.Dir),
+					zap.Uint64s("segments", report.Segments),
+					zap.Uint64("bytes", report.Bytes),
+					zap.Uint64("lowest_offset", report.LowestOffset),
+				)
+			}
+		})
+	}
+}
+
+// stopBackground stops the background tasks and waits for them. They take the lock themselves, so it mustn't be held.
+func (l *Log) stopBackground() {
+	if l.done != nil {
+		close(l.done)
+		l.done = nil
+		l.background.Wait()
+	}
+}
+
+// segmentBaseOffsets returns the base offsets of the segments in the directory listing in ascending order.
+func segmentBaseOffsets(files []os.DirEntry) []uint64 {
+	// We extract the segment offsets from the store file names. This assums that the log files are named in the format {offset}.{ext}
 	var baseOffsets []uint64
 	for _, file := range files {
-		offStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
-		off, _ := strconv.ParseUint(offStr, 10, 0)
+		if file.IsDir() || path.Ext(file.Name()) != ".store" {
+			continue
+		}
+		off, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ".store"), 10, 0)
+		if err != nil {
+			continue
+		}
 		baseOffsets = append(baseOffsets, off)
 	}
 
@@ -55,49 +224,270 @@ func (l *Log) setup() error {
 	sort.Slice(baseOffsets, func(i, j int) bool {
 		return baseOffsets[i] < baseOffsets[j]
 	})
+	return baseOffsets
+}
 
-	// Create the segments for each segment offset
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
-			return err
-		}
-		i++
-	}
-	if l.segments == nil {
-		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
+// loadState rebuilds the producers' latest sequences and the transactions from the records in the log.
+func (l *Log) loadState() error {
+	l.producers = producers{}
+	l.transactions = newTransactions()
+	for _, s := range l.segments {
+		err := s.forEach(func(record *api.Record) error {
+			l.producers.add(record)
+			l.transactions.add(record)
+			return nil
+		})
+		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// every runs fn in the background at the interval until the log is closed.
+func (l *Log) every(interval time.Duration, fn func(logger *zap.Logger)) {
+	logger := zap.L().Named("log")
+	done := l.done
+	l.background.Add(1)
+	go func() {
+		defer l.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fn(logger)
+			}
+		}
+	}()
+}
+
+// Append appends the record and returns its offset. With SyncAlways it only returns once the record was fsynced.
+// If the record is a retry of one an idempotent producer already appended, the original offset is returned instead.
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	return l.appendSync(record, nil)
+}
+
+// AppendAt appends the record only if it gets the expected offset, failing with an ErrOffsetMismatch carrying the log's next offset if it wouldn't.
+// The check happens under the same lock as the append, so writers racing for an offset can't both get it.
+// A retry from an idempotent producer returns its original offset without being checked, as it was already appended.
+func (l *Log) AppendAt(record *api.Record, expected uint64) (uint64, error) {
+	return l.appendSync(record, &expected)
+}
+
+func (l *Log) appendSync(record *api.Record, expected *uint64) (uint64, error) {
+	off, err := l.append(record, expected)
+	if err != nil {
+		return 0, err
+	}
+	// We wait for the fsync after releasing the lock, so other appends can join it.
+	return off, l.afterAppend(off + 1)
+}
+
+func (l *Log) append(record *api.Record, expected *uint64) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if record.ProducerId != 0 {
+		if off, ok, err := l.producers.lookup(record); ok || err != nil {
+			return off, err
+		}
+	}
+	if next := l.activeSegment.nextOffset; expected != nil && *expected != next {
+		return 0, api.ErrOffsetMismatch{Expected: *expected, Actual: next}
+	}
+	if err := l.transactions.check(record); err != nil {
+		return 0, err
+	}
+	size := l.activeSegment.store.size
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
 		return 0, err
 	}
+	l.producers.add(record)
+	l.transactions.add(record)
+	l.written.Add(l.activeSegment.store.size - size)
+	l.notify()
 	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(off + 1)
+		err = l.roll(off + 1)
 	}
 	return off, err
 }
 
+// roll seals the active segment and starts a new one at the offset.
+// Only the active segment is fsynced by the durability policy, so unless syncing is left to the OS the sealed segment is fsynced first.
+func (l *Log) roll(baseOffset uint64) error {
+	if l.Config.Durability.Sync != SyncNever {
+		if err := l.activeSegment.store.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := l.newSegment(baseOffset); err != nil {
+		return err
+	}
+	l.publish()
+	return nil
+}
+
+// AppendBatch appends the records under a single lock, so they get consecutive offsets. It returns the offset of the first record.
+// With a codec configured, the records are compressed as one frame per segment they land in.
+// If an append fails part way through, the records before it stay in the log. With SyncAlways it only returns once the records were fsynced.
+func (l *Log) AppendBatch(records []*api.Record) (uint64, error) {
+	first, err := l.appendBatch(records)
+	if err != nil {
+		return 0, err
+	}
+	return first, l.afterAppend(first + uint64(len(records)))
+}
+
+func (l *Log) appendBatch(records []*api.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	first := l.activeSegment.nextOffset
+	// The records appended before a failure stay in the log, so their readers are woken either way.
+	defer func() {
+		if l.activeSegment.nextOffset != first {
+			l.notify()
+		}
+	}()
+	for len(records) > 0 {
+		n := 1
+		var err error
+		size := l.activeSegment.store.size
+		if codec := l.Config.Segment.Codec; codec != api.Codec_CODEC_NONE {
+			// A frame can't span segments, so the batch is split where the active segment's index fills up.
+			n = min(len(records), l.activeSegment.capacity())
+			_, err = l.activeSegment.AppendBatch(records[:n], codec)
+		} else {
+			_, err = l.activeSegment.Append(records[0])
+		}
+		if err != nil {
+			return 0, err
+		}
+		l.written.Add(l.activeSegment.store.size - size)
+		for _, record := range records[:n] {
+			l.producers.add(record)
+			l.transactions.add(record)
+		}
+		records = records[n:]
+		if l.activeSegment.IsMaxed() {
+			if err = l.roll(l.activeSegment.nextOffset); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return first, nil
+}
+
+// Read returns the record at the offset. Compacted logs have gaps, so if the record was removed we return the next record after it.
+// Reads don't take the lock, so they don't wait for appends: the segment is looked up in the latest snapshot and read while it's guarded against being closed.
+// If retention, compaction or a truncation closed it first, we read again under the lock once they're done.
 func (l *Log) Read(offset uint64) (*api.Record, error) {
+	if record, ok, err := readSegments(*l.snapshot.Load(), offset, true); ok {
+		return record, err
+	}
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	var s *segment
-	for _, segment := range l.segments {
-		if segment.baseOffset <= offset && offset < segment.nextOffset {
-			s = segment
-			break
+	record, _, err := readSegments(l.segments, offset, false)
+	return record, err
+}
+
+// readSegments returns the first record at or after the offset in the segments.
+// Shared readers don't hold the log's lock, and get false back if one of the segments they needed was closed.
+func readSegments(segments []*segment, offset uint64, shared bool) (*api.Record, bool, error) {
+	if offset < segments[0].baseOffset {
+		return nil, true, api.ErrOffsetOutOfRange{Offset: offset}
+	}
+	for i := findSegment(segments, offset); i < len(segments); i++ {
+		s := segments[i]
+		// The offsets between segments were compacted away from the end of the previous one, so we carry on from the next segment's first record.
+		off := max(offset, s.baseOffset)
+		var record *api.Record
+		var err error
+		if shared {
+			var ok bool
+			if record, ok, err = s.readShared(off); !ok {
+				return nil, false, nil
+			}
+		} else {
+			record, err = s.Read(off)
 		}
+		// Every record after the offset in this segment was compacted away, so we move on to the next one.
+		if err == io.EOF {
+			continue
+		}
+		return record, true, err
 	}
-	if s == nil || s.nextOffset <= offset {
-		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+	return nil, true, api.ErrOffsetOutOfRange{Offset: offset}
+}
+
+// findSegment returns the position of the last segment that starts at or before the offset, or -1 if they all start after it.
+// Segments are kept in offset order, so we binary search their base offsets rather than scanning logs with thousands of segments.
+func findSegment(segments []*segment, offset uint64) int {
+	return sort.Search(len(segments), func(i int) bool {
+		return segments[i].baseOffset > offset
+	}) - 1
+}
+
+// publish makes the segments visible to Read. We copy them, as compaction swaps segments in place. The caller must hold the write lock.
+func (l *Log) publish() {
+	segments := make([]*segment, len(l.segments))
+	copy(segments, l.segments)
+	l.snapshot.Store(&segments)
+}
+
+// notify wakes everyone waiting for records to be appended, so they check the log again. The caller must hold the write lock.
+func (l *Log) notify() {
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// Wait blocks until there is a record at or after the offset to read, or the context is done.
+// It returns an ErrOffsetOutOfRange if the offset is before the start of the log, as it will never be appended.
+func (l *Log) Wait(ctx context.Context, offset uint64) error {
+	return l.wait(ctx, offset, l.Read)
+}
+
+// wait blocks until read returns a record for the offset, checking again whenever the log changes.
+func (l *Log) wait(ctx context.Context, offset uint64, read func(uint64) (*api.Record, error)) error {
+	for {
+		// We take the channel before reading, so we can't miss an append that happens in between.
+		l.mu.RLock()
+		lowest, appended := l.segments[0].baseOffset, l.appended
+		l.mu.RUnlock()
+		if offset < lowest {
+			return api.ErrOffsetOutOfRange{Offset: offset}
+		}
+		_, err := read(offset)
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(api.ErrOffsetOutOfRange); !ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-appended:
+		}
 	}
-	return s.Read(offset)
+}
+
+// OffsetForTime returns the offset of the first record appended at or after the time.
+// If every record is older, it returns the offset the next record will be appended at.
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	timestamp := t.UnixNano()
+	for _, s := range l.segments {
+		off, err := s.offsetForTime(timestamp)
+		if err == io.EOF {
+			continue
+		}
+		return off, err
+	}
+	return l.activeSegment.nextOffset, nil
 }
 
 func (l *Log) newSegment(baseOffset uint64) error {
@@ -111,8 +501,15 @@ func (l *Log) newSegment(baseOffset uint64) error {
 }
 
 func (l *Log) Close() error {
+	// The background tasks take the lock themselves, so we stop them before taking it.
+	l.stopBackground()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
 	for _, s := range l.segments {
 		if err := s.Close(); err != nil {
 			return err
@@ -128,17 +525,89 @@ func (l *Log) Remove() error {
 	return os.RemoveAll(l.Dir)
 }
 
+// Reset removes every record, and the log starts again at the configured initial offset.
 func (l *Log) Reset() error {
-	if err := l.Remove(); err != nil {
+	return l.replace(l.Config.Segment.InitialOffset, 0, nil)
+}
+
+// replace removes every record and starts the log again at the lowest offset, then appends the records read by fill at their own offsets.
+// If the last records fill appends come before next, the log carries on from next, as the records in between were compacted away where they came from.
+// It all happens under the lock, so readers see either the old records or the new ones and never a log without segments.
+func (l *Log) replace(lowest, next uint64, fill func(write func(records []*api.Record) error) error) error {
+	l.stopBackground()
+	defer l.startBackground()
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range l.segments {
+		if err := s.Close(); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(l.Dir); err != nil {
+		return err
+	}
+	if err := l.open(lowest); err != nil {
 		return err
 	}
-	return l.setup()
+	// Subscriptions that delivered the removed records go back to the start of the new ones.
+	for sub := range l.subscriptions {
+		sub.truncated(lowest)
+	}
+	if fill != nil {
+		if err := fill(l.write); err != nil {
+			return err
+		}
+	}
+	if next > l.activeSegment.nextOffset {
+		if err := l.roll(next); err != nil {
+			return err
+		}
+	}
+	l.notify()
+	return l.loadState()
+}
+
+// write appends records that already have offsets, keeping their offsets and timestamps. It's how replace copies records from another log. The caller must hold the write lock.
+// With a codec configured, records that were compressed together stay together as long as they fit in the active segment.
+func (l *Log) write(records []*api.Record) error {
+	for len(records) > 0 {
+		if records[0].Offset < l.activeSegment.nextOffset {
+			return fmt.Errorf("record at offset %d is before the next offset %d", records[0].Offset, l.activeSegment.nextOffset)
+		}
+		// The index stores offsets relative to the segment, so a record too far after the segment's base starts a new one.
+		if records[0].Offset-l.activeSegment.baseOffset > math.MaxUint32 {
+			if err := l.roll(records[0].Offset); err != nil {
+				return err
+			}
+		}
+		n := 1
+		var err error
+		size := l.activeSegment.store.size
+		if codec := l.Config.Segment.Codec; codec != api.Codec_CODEC_NONE && len(records) > 1 && l.activeSegment.capacity() >= len(records) && records[len(records)-1].Offset-l.activeSegment.baseOffset <= math.MaxUint32 {
+			n = len(records)
+			err = l.activeSegment.appendBatch(records, codec)
+		} else {
+			_, err = l.activeSegment.append(records[0])
+		}
+		if err != nil {
+			return err
+		}
+		l.written.Add(l.activeSegment.store.size - size)
+		records = records[n:]
+		if l.activeSegment.IsMaxed() {
+			// The next record could be anywhere after this one, so the new segment starts right after it and can have a gap at its start.
+			if err = l.roll(l.activeSegment.nextOffset); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (l *Log) LowestOffset() (uint64, error) {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-	return l.segments[0].baseOffset, nil
+	return (*l.snapshot.Load())[0].baseOffset, nil
 }
 
 func (l *Log) HighestOffset() (uint64, error) {
@@ -151,12 +620,22 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return offset - 1, nil
 }
 
+// nextOffset returns the offset the next record will be appended at. Unlike HighestOffset, it tells an empty log apart from one holding a single record.
+func (l *Log) nextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment.nextOffset
+}
+
 func (l *Log) Truncate(lowest uint64) error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	var segments []*segment
 	for _, s := range l.segments {
-		if s.baseOffset <= lowest+1 {
+		// Only remove segments whose records are all at or below the lowest offset.
+		if s.nextOffset <= lowest+1 {
 			if err := s.Remove(); err != nil {
 				return err
 			}
@@ -166,26 +645,76 @@ func (l *Log) Truncate(lowest uint64) error {
 
 	}
 	l.segments = segments
+	// Anyone waiting on records that were removed finds out they're gone.
+	l.notify()
+	// If every segment was removed, we start a fresh active segment after the truncated offset.
+	if len(l.segments) == 0 {
+		if err := l.newSegment(lowest + 1); err != nil {
+			return err
+		}
+	}
+	l.publish()
+	l.transactions.trim(l.segments[0].baseOffset)
 	return nil
 }
 
-func (l *Log) Reader() io.Reader {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-	readers := make([]io.Reader, len(l.segments))
-	for i, s := range l.segments {
-		readers[i] = &originReader{s.store, 0}
+// truncateFrom removes every record with an offset greater than or equal to the given offset, so the next append is written at that offset.
+func (l *Log) truncateFrom(offset uint64) error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var segments []*segment
+	for _, s := range l.segments {
+		if s.baseOffset >= offset {
+			if err := s.Remove(); err != nil {
+				return err
+			}
+			continue
+		}
+		if offset < s.nextOffset {
+			if err := s.truncate(offset); err != nil {
+				return err
+			}
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	l.resetSynced(offset)
+	// Subscriptions that delivered removed records go back for the ones appended in their place.
+	for sub := range l.subscriptions {
+		sub.truncated(offset)
+	}
+	l.notify()
+	if len(l.segments) == 0 {
+		if err := l.newSegment(offset); err != nil {
+			return err
+		}
 	}
-	return io.MultiReader(readers...)
+	l.activeSegment = l.segments[len(l.segments)-1]
+	l.publish()
+	// The removed records might have been anywhere in the producers' sequences and the transactions, so we rebuild them from what's left.
+	return l.loadState()
 }
 
-type originReader struct {
-	*store
-	offset int64
+// Reader returns a reader of the log's records as they are now, as checksummed frames. Records appended after it was called aren't read, so it's a point-in-time copy.
+func (l *Log) Reader() io.Reader {
+	_, _, r := l.pointInTime()
+	return r
 }
 
-func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.offset)
-	o.offset += int64(n)
-	return n, err
+// pointInTime returns the log's lowest offset, its next offset and a reader of its records, all as they are at the same moment.
+func (l *Log) pointInTime() (lowest, next uint64, r io.Reader) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	frames := &frameReader{
+		stores: make([]*store, len(l.segments)),
+		sizes:  make([]uint64, len(l.segments)),
+	}
+	for i, s := range l.segments {
+		// The active segment keeps growing, so we stop at the size it has now.
+		frames.stores[i] = s.store
+		frames.sizes[i] = s.store.size
+	}
+	return l.segments[0].baseOffset, l.activeSegment.nextOffset, frames
 }
@@ -1,9 +1,15 @@
 package log
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"math/rand/v2"
 	"os"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	api "github.com/MartinMinkov/proglog/api/v1"
 	"github.com/stretchr/testify/require"
@@ -19,6 +25,14 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"offset for time":                   testOffsetForTime,
+		"append batch":                      testAppendBatch,
+		"append compressed batches":         testAppendCompressedBatch,
+		"truncate from inside a batch":      testTruncateFromBatch,
+		"wait for appends":                  testWait,
+		"conditional appends":               testAppendAt,
+		"reads while segments are removed":  testConcurrentReads,
+		"legacy stores aren't appended to":  testLegacyStore,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := os.MkdirTemp(os.TempDir(), "log_test")
@@ -99,7 +113,7 @@ func testReader(t *testing.T, log *Log) {
 	require.NoError(t, err)
 
 	read := &api.Record{}
-	err = proto.Unmarshal(b[lenWidth:], read)
+	err = proto.Unmarshal(b[lenWidth+crcWidth:], read)
 	require.NoError(t, err)
 	require.Equal(t, read.Value, append.Value)
 }
@@ -120,3 +134,346 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func testOffsetForTime(t *testing.T, log *Log) {
+	// The log is empty, so consumers start at the first offset.
+	off, err := log.OffsetForTime(time.Now())
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	var times []time.Time
+	for i := 0; i < 3; i++ {
+		times = append(times, time.Now())
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	for i, ts := range times {
+		off, err := log.OffsetForTime(ts)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+
+	off, err = log.OffsetForTime(time.Now())
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// The timestamps survive a restart.
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	off, err = n.OffsetForTime(times[1])
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func testAppendBatch(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+
+	// The batch is bigger than a segment, so it rolls over to new segments part way through.
+	batch := []*api.Record{
+		{Value: []byte("hello world")},
+		{Value: []byte("hello again")},
+		{Value: []byte("hello there")},
+	}
+	base, err := log.AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), base)
+
+	for i, want := range batch {
+		got, err := log.Read(base + uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, base+uint64(i), got.Offset)
+	}
+}
+
+func testAppendCompressedBatch(t *testing.T, log *Log) {
+	var want [][]byte
+	// Every batch is written with a different codec, so the segments mix them.
+	for _, codec := range []api.Codec{
+		api.Codec_CODEC_NONE,
+		api.Codec_CODEC_GZIP,
+		api.Codec_CODEC_SNAPPY,
+		api.Codec_CODEC_ZSTD,
+	} {
+		log.Config.Segment.Codec = codec
+		var batch []*api.Record
+		for i := 0; i < 3; i++ {
+			value := []byte(codec.String() + " hello world")
+			want = append(want, value)
+			batch = append(batch, &api.Record{Value: value})
+		}
+		_, err := log.AppendBatch(batch)
+		require.NoError(t, err)
+	}
+
+	// The codec is recorded in every batch, so the log reads them back whatever its own codec is.
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	for off, value := range want {
+		got, err := n.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, value, got.Value)
+		require.Equal(t, uint64(off), got.Offset)
+	}
+}
+
+func testTruncateFromBatch(t *testing.T, log *Log) {
+	log.Config.Segment.MaxStoreBytes = 1024
+	log.Config.Segment.Codec = api.Codec_CODEC_GZIP
+	require.NoError(t, log.Reset())
+	batch := []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+		{Value: []byte("third")},
+	}
+	_, err := log.AppendBatch(batch)
+	require.NoError(t, err)
+
+	// The records before the offset share the batch's frame, so they have to survive the truncation.
+	require.NoError(t, log.truncateFrom(1))
+	got, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), got.Value)
+	_, err = log.Read(1)
+	require.Error(t, err)
+
+	off, err := log.Append(&api.Record{Value: []byte("again")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	got, err = log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("again"), got.Value)
+}
+
+func testWait(t *testing.T, log *Log) {
+	ctx := context.Background()
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	// The record is already there, so there's nothing to wait for.
+	require.NoError(t, log.Wait(ctx, off))
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, log.Wait(timeout, off+1), context.DeadlineExceeded)
+
+	waited := make(chan error)
+	go func() {
+		waited <- log.Wait(ctx, off+2)
+	}()
+	// Appending the next record isn't enough, we're waiting for the one after it.
+	_, err = log.Append(&api.Record{Value: []byte("hello again")})
+	require.NoError(t, err)
+	select {
+	case err = <-waited:
+		t.Fatalf("wait returned before the record was appended: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	_, err = log.AppendBatch([]*api.Record{{Value: []byte("batched")}})
+	require.NoError(t, err)
+	require.NoError(t, <-waited)
+
+	// Offsets before the start of the log are never appended.
+	require.NoError(t, log.Truncate(off))
+	require.Error(t, log.Wait(ctx, off))
+}
+
+func testAppendAt(t *testing.T, log *Log) {
+	off, err := log.AppendAt(&api.Record{Value: []byte("first")}, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// Two writers that both read up to the first record race to append the next one, only one of them gets it.
+	appended := make(chan error, 2)
+	for _, value := range []string{"second", "conflicting"} {
+		go func(value string) {
+			_, err := log.AppendAt(&api.Record{Value: []byte(value)}, 1)
+			appended <- err
+		}(value)
+	}
+	var errs []error
+	for range 2 {
+		if err := <-appended; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	require.Equal(t, []error{api.ErrOffsetMismatch{Expected: 1, Actual: 2}}, errs)
+
+	// Retries from idempotent producers return their original offset, even though the log moved on.
+	off, err = log.AppendAt(&api.Record{Value: []byte("third"), ProducerId: 1}, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	off, err = log.AppendAt(&api.Record{Value: []byte("third"), ProducerId: 1}, 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	_, err = log.AppendAt(&api.Record{Value: []byte("stale")}, 2)
+	require.Equal(t, api.ErrOffsetMismatch{Expected: 2, Actual: 3}, err)
+}
+
+func testConcurrentReads(t *testing.T, log *Log) {
+	log.Config.Retention.MaxSegments = 3
+	done := make(chan error)
+	go func() {
+		done <- func() error {
+			for i := 1; i <= 300; i++ {
+				off, err := log.Append(&api.Record{Value: []byte("hello world")})
+				if err != nil {
+					return err
+				}
+				switch {
+				case i%10 == 0:
+					_, err = log.Retain()
+				case i%25 == 0:
+					// Truncating rewrites the active segment in place, under readers that might be in the middle of it.
+					err = log.truncateFrom(off)
+				case i%37 == 0:
+					// Resetting swaps every segment, which readers must never see half done.
+					err = log.Reset()
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}()
+	}()
+	for {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+			return
+		default:
+		}
+		lowest, err := log.LowestOffset()
+		require.NoError(t, err)
+		highest, err := log.HighestOffset()
+		require.NoError(t, err)
+		for _, off := range []uint64{lowest, highest} {
+			// The record can be removed between looking up the offset and reading it, which is the only error we expect.
+			_, err = log.Read(off)
+			if _, ok := err.(api.ErrOffsetOutOfRange); !ok {
+				require.NoError(t, err)
+			}
+		}
+	}
+}
+
+// benchmarkLog returns a log with a record in each of the given number of segments.
+func benchmarkLog(b *testing.B, segments int) *Log {
+	b.Helper()
+	if most := maxBenchmarkSegments(b); segments > most {
+		b.Skipf("%d segments need more open files than the limit allows, which is enough for %d", segments, most)
+	}
+	dir := b.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1
+	log, err := NewLog(dir, c)
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		log.Close()
+	})
+	for i := 0; i < segments; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(b, err)
+	}
+	return log
+}
+
+// maxBenchmarkSegments returns how many segments a benchmark can open, at most 10k.
+// Every segment keeps its store, index and time index open, so it depends on the open file limit. Go raises the soft limit to the hard one on start up.
+func maxBenchmarkSegments(b *testing.B) int {
+	b.Helper()
+	var limit syscall.Rlimit
+	require.NoError(b, syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit))
+	// We leave some files for everything else the test binary has open.
+	return int(min(10_000, (max(limit.Cur, 100)-100)/3))
+}
+
+func BenchmarkFindSegment(b *testing.B) {
+	// The lookup only needs the base offsets, so we don't open 10k segments' files.
+	segments := make([]*segment, 10_000)
+	for i := range segments {
+		segments[i] = &segment{baseOffset: uint64(i) * 100}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		findSegment(segments, uint64(i%len(segments))*100+50)
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	// The largest case is 10k segments where the open file limit allows it, and as many as it allows otherwise.
+	for _, segments := range []int{10, 1_000, maxBenchmarkSegments(b)} {
+		b.Run(fmt.Sprintf("segments=%d", segments), func(b *testing.B) {
+			log := benchmarkLog(b, segments)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := log.Read(uint64(rand.IntN(segments))); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkReadWhileAppending(b *testing.B) {
+	log := benchmarkLog(b, 1_000)
+	// The segments rolled from now on are big enough that the appends don't open a segment each.
+	log.Config.Segment.MaxStoreBytes = 1 << 30
+	log.Config.Segment.MaxIndexBytes = 1 << 24
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	// The appender is stopped before the log is closed by the cleanup, which runs after we return.
+	defer wg.Wait()
+	defer close(done)
+	wg.Add(1)
+	// Reads don't take the log's lock, so they shouldn't slow down while another goroutine keeps appending.
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			log.Append(&api.Record{Value: []byte("hello again")})
+		}
+	}()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := log.Read(uint64(rand.IntN(1_000))); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func testLegacyStore(t *testing.T, log *Log) {
+	require.NoError(t, log.Remove())
+	require.NoError(t, os.MkdirAll(log.Dir, 0755))
+	// A store written before stores had a header or records had checksums.
+	p, err := proto.Marshal(&api.Record{Value: []byte("legacy")})
+	require.NoError(t, err)
+	b := make([]byte, lenWidth)
+	enc.PutUint64(b, uint64(len(p)))
+	require.NoError(t, os.WriteFile(segmentPath(log.Dir, 0, ".store"), append(b, p...), 0644))
+
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	read, err := n.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("legacy"), read.Value)
+	off, err := n.Append(&api.Record{Value: []byte("new")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	// The record went to a new segment, whose store has a header.
+	require.Equal(t, uint64(1), n.segments[1].baseOffset)
+	require.Equal(t, uint64(storeHeaderWidth), n.segments[1].store.start)
+}
@@ -0,0 +1,128 @@
+package log
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+)
+
+/**
+ * Offsets stores the offsets consumer groups have committed for each topic partition.
+ * Every commit is appended to an internal log keyed by (group, topic, partition), so only the latest record for a key matters and the log can be compacted.
+ * The latest offsets are kept in memory and rebuilt from the log on startup.
+ */
+type Offsets struct {
+	mu      sync.RWMutex
+	log     *Log
+	offsets map[offsetKey]uint64
+}
+
+type offsetKey struct {
+	group     string
+	topic     string
+	partition uint32
+}
+
+func NewOffsets(dir string, c Config) (*Offsets, error) {
+	l, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	o := &Offsets{
+		log:     l,
+		offsets: make(map[offsetKey]uint64),
+	}
+	return o, o.load()
+}
+
+// load replays the log so the latest commit for every key wins.
+func (o *Offsets) load() error {
+	lowest, err := o.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+	// The offsets log is compacted, so we continue after each record we read rather than at the next offset.
+	for off := lowest; ; {
+		record, err := o.log.Read(off)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		key, err := decodeOffsetKey(record.Key)
+		if err != nil {
+			return err
+		}
+		o.offsets[key] = enc.Uint64(record.Value)
+		off = record.Offset + 1
+	}
+}
+
+// Commit durably records the group's offset for the topic partition.
+func (o *Offsets) Commit(group, topic string, partition uint32, offset uint64) error {
+	key := offsetKey{group: group, topic: topic, partition: partition}
+	value := make([]byte, 8)
+	enc.PutUint64(value, offset)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, err := o.log.Append(&api.Record{Key: key.encode(), Value: value}); err != nil {
+		return err
+	}
+	o.offsets[key] = offset
+	return nil
+}
+
+// Fetch returns the group's last committed offset for the topic partition, and whether it has committed one at all.
+func (o *Offsets) Fetch(group, topic string, partition uint32) (uint64, bool, error) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	offset, ok := o.offsets[offsetKey{group: group, topic: topic, partition: partition}]
+	return offset, ok, nil
+}
+
+func (o *Offsets) Close() error {
+	return o.log.Close()
+}
+
+func (o *Offsets) Remove() error {
+	return o.log.Remove()
+}
+
+// encode writes the key as the length prefixed group and topic followed by the partition.
+func (k offsetKey) encode() []byte {
+	b := make([]byte, 0, 2*binary.MaxVarintLen64+len(k.group)+len(k.topic)+4)
+	b = binary.AppendUvarint(b, uint64(len(k.group)))
+	b = append(b, k.group...)
+	b = binary.AppendUvarint(b, uint64(len(k.topic)))
+	b = append(b, k.topic...)
+	return enc.AppendUint32(b, k.partition)
+}
+
+var errInvalidOffsetKey = errors.New("invalid consumer offset key")
+
+func decodeOffsetKey(b []byte) (offsetKey, error) {
+	var k offsetKey
+	var ok bool
+	if k.group, b, ok = decodeString(b); !ok {
+		return k, errInvalidOffsetKey
+	}
+	if k.topic, b, ok = decodeString(b); !ok {
+		return k, errInvalidOffsetKey
+	}
+	if len(b) != 4 {
+		return k, errInvalidOffsetKey
+	}
+	k.partition = enc.Uint32(b)
+	return k, nil
+}
+
+func decodeString(b []byte) (string, []byte, bool) {
+	n, w := binary.Uvarint(b)
+	if w <= 0 || uint64(len(b)-w) < n {
+		return "", nil, false
+	}
+	return string(b[w : w+int(n)]), b[w+int(n):], true
+}
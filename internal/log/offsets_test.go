@@ -0,0 +1,46 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffsets(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "offsets_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	offsets, err := NewOffsets(dir, Config{})
+	require.NoError(t, err)
+
+	_, committed, err := offsets.Fetch("billing", "orders", 0)
+	require.NoError(t, err)
+	require.False(t, committed)
+
+	require.NoError(t, offsets.Commit("billing", "orders", 0, 5))
+	require.NoError(t, offsets.Commit("billing", "orders", 0, 7))
+	require.NoError(t, offsets.Commit("billing", "orders", 1, 2))
+	require.NoError(t, offsets.Commit("shipping", "orders", 0, 3))
+	require.NoError(t, offsets.Close())
+
+	// The latest commit for each (group, topic, partition) survives a restart.
+	offsets, err = NewOffsets(dir, Config{})
+	require.NoError(t, err)
+	for _, want := range []struct {
+		group     string
+		partition uint32
+		offset    uint64
+	}{
+		{group: "billing", partition: 0, offset: 7},
+		{group: "billing", partition: 1, offset: 2},
+		{group: "shipping", partition: 0, offset: 3},
+	} {
+		offset, committed, err := offsets.Fetch(want.group, "orders", want.partition)
+		require.NoError(t, err)
+		require.True(t, committed)
+		require.Equal(t, want.offset, offset)
+	}
+	require.NoError(t, offsets.Remove())
+}
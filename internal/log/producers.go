@@ -0,0 +1,51 @@
+package log
+
+import (
+	api "github.com/MartinMinkov/proglog/api/v1"
+)
+
+// sequenceWindow is how many of each producer's latest sequences we remember the offsets of, which bounds how far back a retry can be recognised.
+const sequenceWindow = 32
+
+// sequenceEntry is a sequence number a producer appended and the offset it got.
+type sequenceEntry struct {
+	sequence uint64
+	offset   uint64
+}
+
+/**
+ * producers remembers the latest sequences each idempotent producer appended to the log, so retries return the original offset instead of appending a duplicate.
+ * Each producer's entries are kept oldest first. The state is rebuilt from the records when the log is opened, as they carry their producer ID and sequence.
+ */
+type producers map[uint64][]sequenceEntry
+
+// lookup returns the offset the record was already appended at, if it's a retry. Only the sequence right after the producer's last one is new.
+// Later sequences are rejected, as the ones in between went missing, and so are earlier ones we don't have an offset for, as we can't tell whether they were appended.
+func (p producers) lookup(record *api.Record) (uint64, bool, error) {
+	entries := p[record.ProducerId]
+	if len(entries) == 0 {
+		return 0, false, nil
+	}
+	last := entries[len(entries)-1].sequence
+	if record.Sequence == last+1 {
+		return 0, false, nil
+	}
+	for _, e := range entries {
+		if e.sequence == record.Sequence {
+			return e.offset, true, nil
+		}
+	}
+	return 0, false, api.ErrSequenceOutOfOrder{ProducerID: record.ProducerId, Sequence: record.Sequence, Last: last}
+}
+
+// add records that the record was appended, if it came from an idempotent producer.
+func (p producers) add(record *api.Record) {
+	if record.ProducerId == 0 {
+		return
+	}
+	entries := append(p[record.ProducerId], sequenceEntry{sequence: record.Sequence, offset: record.Offset})
+	if len(entries) > sequenceWindow {
+		entries = append(entries[:0], entries[len(entries)-sequenceWindow:]...)
+	}
+	p[record.ProducerId] = entries
+}
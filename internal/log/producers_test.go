@@ -0,0 +1,112 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProducers(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, log *Log,
+	){
+		"retries return the original offset":          testProducerRetry,
+		"producers are tracked separately":            testProducersSeparate,
+		"sequences older than the window are refused": testProducerWindow,
+		"sequences that skip ahead are refused":       testProducerGap,
+		"sequences are rebuilt from the log":          testProducersReopen,
+		"truncated sequences can be appended again":   testProducerTruncate,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp(os.TempDir(), "producers_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 3
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			fn(t, log)
+		})
+	}
+}
+
+func produce(t *testing.T, log *Log, producer, sequence uint64) uint64 {
+	t.Helper()
+	off, err := log.Append(&api.Record{Value: []byte("hello world"), ProducerId: producer, Sequence: sequence})
+	require.NoError(t, err)
+	return off
+}
+
+func testProducerRetry(t *testing.T, log *Log) {
+	first := produce(t, log, 1, 0)
+	second := produce(t, log, 1, 1)
+	require.Equal(t, first, produce(t, log, 1, 0))
+	require.Equal(t, second, produce(t, log, 1, 1))
+	// Records without a producer are never deduplicated.
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), highest)
+}
+
+func testProducersSeparate(t *testing.T, log *Log) {
+	require.Equal(t, uint64(0), produce(t, log, 1, 0))
+	require.Equal(t, uint64(1), produce(t, log, 2, 0))
+	require.Equal(t, uint64(0), produce(t, log, 1, 0))
+	require.Equal(t, uint64(1), produce(t, log, 2, 0))
+}
+
+func testProducerWindow(t *testing.T, log *Log) {
+	for seq := uint64(0); seq < sequenceWindow+2; seq++ {
+		produce(t, log, 1, seq)
+	}
+	// The first two sequences fell out of the window, so we can't tell whether a retry of them was appended.
+	_, err := log.Append(&api.Record{ProducerId: 1, Sequence: 1})
+	require.Equal(t, api.ErrSequenceOutOfOrder{ProducerID: 1, Sequence: 1, Last: sequenceWindow + 1}, err)
+	require.Equal(t, uint64(2), produce(t, log, 1, 2))
+}
+
+func testProducerGap(t *testing.T, log *Log) {
+	produce(t, log, 1, 0)
+	// The sequences in between went missing, so the producer has to send them first.
+	_, err := log.Append(&api.Record{ProducerId: 1, Sequence: 2})
+	require.Equal(t, api.ErrSequenceOutOfOrder{ProducerID: 1, Sequence: 2, Last: 0}, err)
+	require.Equal(t, uint64(1), produce(t, log, 1, 1))
+	require.Equal(t, uint64(2), produce(t, log, 1, 2))
+}
+
+func testProducersReopen(t *testing.T, log *Log) {
+	produce(t, log, 1, 0)
+	// Batched records are tracked too, so a restored log knows about them.
+	first, err := log.AppendBatch([]*api.Record{
+		{ProducerId: 2, Sequence: 0},
+		{ProducerId: 2, Sequence: 1},
+	})
+	require.NoError(t, err)
+	produce(t, log, 1, 1)
+	require.NoError(t, log.Close())
+
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	require.Equal(t, uint64(0), produce(t, n, 1, 0))
+	require.Equal(t, first+1, produce(t, n, 2, 1))
+	require.Equal(t, uint64(3), produce(t, n, 1, 1))
+	require.Equal(t, uint64(4), produce(t, n, 1, 2))
+}
+
+func testProducerTruncate(t *testing.T, log *Log) {
+	produce(t, log, 1, 0)
+	produce(t, log, 1, 1)
+	produce(t, log, 1, 2)
+	require.NoError(t, log.truncateFrom(1))
+	// The records after the truncation are gone, so their sequences are new again.
+	require.Equal(t, uint64(1), produce(t, log, 1, 1))
+	require.Equal(t, uint64(0), produce(t, log, 1, 0))
+}
@@ -0,0 +1,122 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"os"
+)
+
+// IndexReport describes how an index rebuilt from its store compares to the index that was on disk.
+type IndexReport struct {
+	// BaseOffset is the base offset of the segment the index belongs to.
+	BaseOffset uint64
+	// Entries is the number of entries in the rebuilt index.
+	Entries int
+	// HadIndex is whether there was an index on disk to compare against.
+	HadIndex bool
+	// Mismatched is the number of entries on disk that differ from the rebuilt ones.
+	Mismatched int
+	// Missing is the number of rebuilt entries the index on disk didn't have.
+	Missing int
+	// Extra is the number of entries on disk past the last record in the store.
+	Extra int
+	// TailBytes is the size of the data at the end of the store that isn't an intact record, which the rebuilt index leaves out.
+	TailBytes uint64
+}
+
+// Matches reports whether the index on disk already matched the store.
+func (r IndexReport) Matches() bool {
+	return r.HadIndex && r.Mismatched == 0 && r.Missing == 0 && r.Extra == 0
+}
+
+/**
+ * RebuildIndex scans the segment's store and regenerates its index from the records in it, comparing the result to the index on disk.
+ * With write set the rebuilt index replaces the one on disk, otherwise the store and index are only checked.
+ * The store is never modified, so the log must not be open while this runs.
+ */
+func RebuildIndex(dir string, baseOffset uint64, write bool) (IndexReport, error) {
+	report := IndexReport{BaseOffset: baseOffset}
+	f, err := os.OpenFile(segmentPath(dir, baseOffset, ".store"), os.O_RDONLY, 0)
+	if err != nil {
+		return report, err
+	}
+	s, err := newStore(f)
+	if err != nil {
+		return report, err
+	}
+	defer f.Close()
+
+	// Every record in a frame gets an entry pointing at the frame.
+	var rebuilt []byte
+	entry := make([]byte, entWidth)
+	// A new store doesn't have its header until the first record is appended.
+	pos := min(s.start, s.size)
+	for pos < s.size {
+		p, width, err := s.readRecord(pos)
+		if err != nil {
+			break
+		}
+		records, err := decodeFrame(p)
+		if err != nil || len(records) == 0 || records[0].Offset < baseOffset {
+			break
+		}
+		for _, record := range records {
+			enc.PutUint32(entry[:offWidth], uint32(record.Offset-baseOffset))
+			enc.PutUint64(entry[offWidth:], pos)
+			rebuilt = append(rebuilt, entry...)
+		}
+		pos += width
+	}
+	report.TailBytes = s.size - pos
+	report.Entries = len(rebuilt) / int(entWidth)
+
+	indexPath := segmentPath(dir, baseOffset, ".index")
+	existing, err := os.ReadFile(indexPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return report, err
+	}
+	report.HadIndex = err == nil
+	existing = existing[:uint64(len(existing))/entWidth*entWidth]
+	// An index that wasn't closed is still the full preallocated size, and the unused entries at the end are all zeros.
+	zero := make([]byte, entWidth)
+	for uint64(len(existing)) > uint64(len(rebuilt)) && bytes.Equal(existing[uint64(len(existing))-entWidth:], zero) {
+		existing = existing[:uint64(len(existing))-entWidth]
+	}
+	for i := uint64(0); i < uint64(len(rebuilt)); i += entWidth {
+		if i >= uint64(len(existing)) {
+			report.Missing++
+		} else if !bytes.Equal(existing[i:i+entWidth], rebuilt[i:i+entWidth]) {
+			report.Mismatched++
+		}
+	}
+	if len(existing) > len(rebuilt) {
+		report.Extra = (len(existing) - len(rebuilt)) / int(entWidth)
+	}
+
+	if !write || report.Matches() {
+		return report, nil
+	}
+	// Write the index next to the old one and swap it in, so a crash never leaves a half written index.
+	tmp := indexPath + ".rebuilt"
+	if err = os.WriteFile(tmp, rebuilt, 0644); err != nil {
+		return report, err
+	}
+	return report, os.Rename(tmp, indexPath)
+}
+
+// RebuildIndexes rebuilds the index of every segment in the log's directory, see RebuildIndex.
+func RebuildIndexes(dir string, write bool) ([]IndexReport, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var reports []IndexReport
+	for _, off := range segmentBaseOffsets(files) {
+		report, err := RebuildIndex(dir, off, write)
+		if err != nil {
+			return reports, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
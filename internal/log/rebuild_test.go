@@ -0,0 +1,121 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebuildIndex(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, log *Log,
+	){
+		"matching index is left alone": testRebuildMatching,
+		"lost index is rebuilt":        testRebuildLost,
+		"corrupted index is rebuilt":   testRebuildCorrupted,
+		"verify only reports":          testRebuildVerify,
+		"torn tail is left out":        testRebuildTornTail,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp(os.TempDir(), "rebuild_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.Codec = api.Codec_CODEC_GZIP
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			_, err = log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+			// Batched records share a frame, so their entries all point at the same position.
+			_, err = log.AppendBatch([]*api.Record{
+				{Value: []byte("first")},
+				{Value: []byte("second")},
+				{Value: []byte("third")},
+			})
+			require.NoError(t, err)
+			require.NoError(t, log.Close())
+			fn(t, log)
+		})
+	}
+}
+
+func testRebuildMatching(t *testing.T, log *Log) {
+	reports, err := RebuildIndexes(log.Dir, true)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	require.True(t, reports[0].Matches())
+	require.Equal(t, 4, reports[0].Entries)
+	requireRebuilt(t, log, 3)
+}
+
+func testRebuildLost(t *testing.T, log *Log) {
+	require.NoError(t, os.Remove(segmentPath(log.Dir, 0, ".index")))
+
+	report, err := RebuildIndex(log.Dir, 0, true)
+	require.NoError(t, err)
+	require.False(t, report.HadIndex)
+	require.Equal(t, 4, report.Missing)
+	requireRebuilt(t, log, 3)
+}
+
+func testRebuildCorrupted(t *testing.T, log *Log) {
+	// Point the second entry somewhere else and add an entry past the end of the store.
+	name := segmentPath(log.Dir, 0, ".index")
+	b, err := os.ReadFile(name)
+	require.NoError(t, err)
+	enc.PutUint64(b[entWidth+offWidth:], 1)
+	b = append(b, b[entWidth*2:entWidth*3]...)
+	require.NoError(t, os.WriteFile(name, b, 0644))
+
+	report, err := RebuildIndex(log.Dir, 0, true)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Mismatched)
+	require.Equal(t, 1, report.Extra)
+	requireRebuilt(t, log, 3)
+
+	report, err = RebuildIndex(log.Dir, 0, false)
+	require.NoError(t, err)
+	require.True(t, report.Matches())
+}
+
+func testRebuildVerify(t *testing.T, log *Log) {
+	name := segmentPath(log.Dir, 0, ".index")
+	require.NoError(t, os.Truncate(name, int64(entWidth)))
+
+	report, err := RebuildIndex(log.Dir, 0, false)
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Missing)
+	fi, err := os.Stat(name)
+	require.NoError(t, err)
+	require.Equal(t, int64(entWidth), fi.Size())
+}
+
+func testRebuildTornTail(t *testing.T, log *Log) {
+	f, err := os.OpenFile(segmentPath(log.Dir, 0, ".store"), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0x80, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	report, err := RebuildIndex(log.Dir, 0, true)
+	require.NoError(t, err)
+	require.True(t, report.Matches())
+	require.Equal(t, uint64(3), report.TailBytes)
+	requireRebuilt(t, log, 3)
+}
+
+// requireRebuilt opens the log again and checks every record up to the offset can be read through the index.
+func requireRebuilt(t *testing.T, log *Log, highest uint64) {
+	t.Helper()
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	for off := uint64(0); off <= highest; off++ {
+		record, err := n.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+}
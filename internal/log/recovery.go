@@ -0,0 +1,119 @@
+package log
+
+// segmentRecovery describes what recover had to repair in a segment.
+type segmentRecovery struct {
+	// DroppedEntries is the number of index entries that pointed at records which didn't make it to the store intact.
+	DroppedEntries int
+	// RebuiltEntries is the number of index entries written for records that made it to the store but not the index.
+	RebuiltEntries int
+	// TruncatedBytes is the size of the partially written tail removed from the store.
+	TruncatedBytes uint64
+}
+
+func (r segmentRecovery) repaired() bool {
+	return r.DroppedEntries > 0 || r.RebuiltEntries > 0 || r.TruncatedBytes > 0
+}
+
+/**
+ * recover repairs the segment's index and store after a crash, so the index only points at intact records and every intact record is indexed.
+ * The index file is only truncated to its real size on close, so after a crash it's still the full preallocated size and ends in zeroed entries. We keep the entries up to the first one that goes backwards or points outside the store.
+ * The records from the last indexed frame onwards are then scanned: entries are written for the records the index is missing, and the store is truncated at the first record that is torn or corrupt.
+ */
+func (s *segment) recover() (segmentRecovery, error) {
+	var report segmentRecovery
+	// Keep the entries with increasing offsets and positions that point inside the store.
+	s.index.size.Store(min(s.index.size.Load(), uint64(len(s.index.mmap))))
+	valid := int64(0)
+	for entries := int64(s.index.size.Load() / entWidth); valid < entries; valid++ {
+		off, pos, err := s.index.Read(valid)
+		if err != nil {
+			return report, err
+		}
+		if pos >= s.store.size {
+			break
+		}
+		if valid > 0 {
+			prevOff, prevPos, err := s.index.Read(valid - 1)
+			if err != nil {
+				return report, err
+			}
+			if off <= prevOff || pos < prevPos {
+				break
+			}
+		}
+	}
+
+	// The last frame might have been torn or only partly indexed, so we drop its entries and scan it again with whatever follows.
+	type indexEntry struct {
+		off uint32
+		pos uint64
+	}
+	entry, scan, next := valid, s.store.start, uint32(0)
+	if valid > 0 {
+		_, scan, _ = s.index.Read(valid - 1)
+		for entry > 0 {
+			off, pos, err := s.index.Read(entry - 1)
+			if err != nil {
+				return report, err
+			}
+			if pos != scan {
+				next = off + 1
+				break
+			}
+			entry--
+		}
+	}
+	// We remember the dropped entries, so the ones the scan writes back unchanged count as neither dropped nor rebuilt.
+	rescanned := make([]indexEntry, 0, valid-entry)
+	for i := entry; i < valid; i++ {
+		off, pos, err := s.index.Read(i)
+		if err != nil {
+			return report, err
+		}
+		rescanned = append(rescanned, indexEntry{off, pos})
+	}
+	kept := 0
+	s.index.size.Store(uint64(entry) * entWidth)
+
+	for scan < s.store.size {
+		p, width, err := s.store.readRecord(scan)
+		if err != nil {
+			break
+		}
+		records, err := decodeFrame(p)
+		if err != nil || len(records) > s.capacity() {
+			break
+		}
+		ok := true
+		for _, record := range records {
+			if record.Offset < s.baseOffset+uint64(next) {
+				ok = false
+				break
+			}
+		}
+		if !ok {
+			break
+		}
+		for _, record := range records {
+			next = uint32(record.Offset-s.baseOffset) + 1
+			if i := int64(s.index.size.Load()/entWidth) - entry; i < int64(len(rescanned)) && rescanned[i] == (indexEntry{next - 1, scan}) {
+				kept++
+			} else {
+				report.RebuiltEntries++
+			}
+			if err = s.index.Write(next-1, scan); err != nil {
+				return report, err
+			}
+		}
+		scan += width
+	}
+
+	if scan < s.store.size {
+		report.TruncatedBytes = s.store.size - scan
+		if err := s.store.Truncate(scan); err != nil {
+			return report, err
+		}
+	}
+	report.DroppedEntries = len(rescanned) - kept
+	return report, nil
+}
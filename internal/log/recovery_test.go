@@ -0,0 +1,126 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRecover(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, log *Log,
+	){
+		"unclosed segment keeps every record":     testRecoverUnclosed,
+		"torn tail is truncated":                  testRecoverTornTail,
+		"garbled last record is dropped":          testRecoverGarbledTail,
+		"records missing from the index are kept": testRecoverMissingEntries,
+		"wrong index entries are replaced":        testRecoverWrongEntry,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp(os.TempDir(), "recovery_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			for i := 0; i < 3; i++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			// The process dies without closing the log, so the index is never truncated to its real size. We flush the store as the OS would have.
+			require.NoError(t, log.activeSegment.store.buf.Flush())
+			fn(t, log)
+		})
+	}
+}
+
+// reopen opens the log again as if the process restarted after a crash.
+func reopen(t *testing.T, log *Log) (*Log, segmentRecovery) {
+	t.Helper()
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	t.Cleanup(func() { n.Close() })
+	return n, n.activeSegment.recovery
+}
+
+// requireRecords checks the log holds the records up to the offset and carries on appending after them.
+func requireRecords(t *testing.T, log *Log, highest uint64) {
+	t.Helper()
+	for off := uint64(0); off <= highest; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	_, err := log.Read(highest + 1)
+	require.Error(t, err)
+	off, err := log.Append(&api.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	require.Equal(t, highest+1, off)
+	record, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("after"), record.Value)
+}
+
+func testRecoverUnclosed(t *testing.T, log *Log) {
+	n, report := reopen(t, log)
+	require.False(t, report.repaired())
+	requireRecords(t, n, 2)
+}
+
+func testRecoverTornTail(t *testing.T, log *Log) {
+	// Only the start of the next record's header made it to disk.
+	f := log.activeSegment.store.File
+	_, err := f.Write([]byte{0x80, 0, 0})
+	require.NoError(t, err)
+
+	n, report := reopen(t, log)
+	require.Equal(t, uint64(3), report.TruncatedBytes)
+	requireRecords(t, n, 2)
+}
+
+func testRecoverGarbledTail(t *testing.T, log *Log) {
+	// Corrupt the last byte of the last record, so its checksum no longer matches.
+	store := log.activeSegment.store
+	f, err := os.OpenFile(store.Name(), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(store.size-1))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	n, report := reopen(t, log)
+	require.Equal(t, 1, report.DroppedEntries)
+	require.NotZero(t, report.TruncatedBytes)
+	requireRecords(t, n, 1)
+}
+
+func testRecoverMissingEntries(t *testing.T, log *Log) {
+	// The record reaches the store, but the process dies before it is indexed.
+	s := log.activeSegment
+	p, err := proto.Marshal(&api.Record{Value: []byte("unindexed"), Offset: 3})
+	require.NoError(t, err)
+	_, _, err = s.store.Append(p)
+	require.NoError(t, err)
+	require.NoError(t, s.store.buf.Flush())
+
+	n, report := reopen(t, log)
+	require.Equal(t, 1, report.RebuiltEntries)
+	record, err := n.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("unindexed"), record.Value)
+	requireRecords(t, n, 3)
+}
+
+func testRecoverWrongEntry(t *testing.T, log *Log) {
+	// The last entry points at the right record but with the wrong offset, so it's dropped and rebuilt, which mustn't cancel out in the report.
+	enc.PutUint32(log.activeSegment.index.mmap[2*entWidth:], 5)
+
+	n, report := reopen(t, log)
+	require.Equal(t, 1, report.DroppedEntries)
+	require.Equal(t, 1, report.RebuiltEntries)
+	require.Zero(t, report.TruncatedBytes)
+	requireRecords(t, n, 2)
+}
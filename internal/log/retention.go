@@ -0,0 +1,66 @@
+package log
+
+import (
+	"time"
+)
+
+// RetentionReport describes what a retention pass removed from the log.
+type RetentionReport struct {
+	// Segments are the base offsets of the removed segments.
+	Segments []uint64
+	// Bytes is the disk space the removed segments took up.
+	Bytes uint64
+	// LowestOffset is the lowest offset left in the log after the pass.
+	LowestOffset uint64
+}
+
+/**
+ * Retain removes the oldest sealed segments that fall outside the configured retention policy.
+ * A segment is removed if it is older than the max age, or if the log is over its max bytes or max segments. Segments are only removed from the start of the log so it never has holes.
+ * The active segment is never removed, so the log always keeps the records that were written last.
+ */
+func (l *Log) Retain() (RetentionReport, error) {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r := l.Config.Retention
+	var report RetentionReport
+	var total uint64
+	for _, s := range l.segments {
+		total += s.size()
+	}
+
+	// The last segment is the active one, so we stop before it.
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		expired := false
+		if r.MaxAge > 0 {
+			modTime, err := s.modTime()
+			if err != nil {
+				return report, err
+			}
+			expired = time.Since(modTime) > r.MaxAge
+		}
+		overBytes := r.MaxBytes > 0 && total > r.MaxBytes
+		overSegments := r.MaxSegments > 0 && len(l.segments) > r.MaxSegments
+		if !expired && !overBytes && !overSegments {
+			break
+		}
+		size := s.size()
+		if err := s.Remove(); err != nil {
+			return report, err
+		}
+		l.segments = l.segments[1:]
+		total -= size
+		report.Segments = append(report.Segments, s.baseOffset)
+		report.Bytes += size
+	}
+	if len(report.Segments) > 0 {
+		l.publish()
+	}
+	report.LowestOffset = l.segments[0].baseOffset
+	l.transactions.trim(report.LowestOffset)
+	return report, nil
+}
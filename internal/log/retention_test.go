@@ -0,0 +1,90 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetain(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, log *Log,
+	){
+		"max segments removes the oldest segments": testRetainMaxSegments,
+		"max bytes removes the oldest segments":    testRetainMaxBytes,
+		"max age removes old segments":             testRetainMaxAge,
+		"never removes the active segment":         testRetainActive,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp(os.TempDir(), "retention_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			// Every record gets its own segment, so all but the last one are sealed.
+			c.Segment.MaxStoreBytes = 1
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			for i := 0; i < 4; i++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			fn(t, log)
+		})
+	}
+}
+
+func testRetainMaxSegments(t *testing.T, log *Log) {
+	log.Config.Retention.MaxSegments = 3
+	report, err := log.Retain()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1}, report.Segments)
+	require.Equal(t, uint64(2), report.LowestOffset)
+
+	_, err = log.Read(1)
+	require.Error(t, err)
+	record, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), record.Offset)
+	_, err = os.Stat(filepath.Join(log.Dir, "0.store"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func testRetainMaxBytes(t *testing.T, log *Log) {
+	removed := log.segments[0].size() + log.segments[1].size()
+	// The active segment is empty, so only the last two records fit.
+	log.Config.Retention.MaxBytes = log.segments[2].size() + log.segments[3].size()
+	report, err := log.Retain()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1}, report.Segments)
+	require.Equal(t, removed, report.Bytes)
+}
+
+func testRetainMaxAge(t *testing.T, log *Log) {
+	log.Config.Retention.MaxAge = time.Hour
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(log.segments[0].store.Name(), old, old))
+
+	report, err := log.Retain()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0}, report.Segments)
+	require.Equal(t, uint64(1), report.LowestOffset)
+}
+
+func testRetainActive(t *testing.T, log *Log) {
+	log.Config.Retention.MaxSegments = 1
+	log.Config.Retention.MaxAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	report, err := log.Retain()
+	require.NoError(t, err)
+	require.Equal(t, 4, len(report.Segments))
+	require.Equal(t, 1, len(log.segments))
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+}
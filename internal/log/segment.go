@@ -1,9 +1,14 @@
 package log
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path"
+	"sync"
+	"time"
 
 	api "github.com/MartinMinkov/proglog/api/v1"
 	"google.golang.org/protobuf/proto"
@@ -15,16 +20,44 @@ type segment struct {
 	baseOffset uint64 // The base offset is used to calculate the relative offset of the index. Because we can have multiple segments, we need to keep track of the base offset for each segment.
 	nextOffset uint64 // The next offset to be used when appending a record
 	config     Config
+
+	timeIndex *timeIndex
+	// maxTimestamp is the newest timestamp of any record in the segment, timeIndexPos is the store position of the last time index entry.
+	maxTimestamp int64
+	timeIndexPos uint64
+
+	// cached holds the records of the batch at cachedPos in the store, which was read last.
+	cacheMu   sync.Mutex
+	cachedPos uint64
+	cached    []*api.Record
+
+	// recovery is what had to be repaired when the segment was opened.
+	recovery segmentRecovery
+
+	// readMu is read locked by readers that found the segment in the log's snapshot, as they don't hold the log's lock.
+	// Closing or truncating the segment write locks it, which waits for those readers and sends new ones to the log's lock until it's done.
+	readMu sync.RWMutex
+	closed bool
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
+	return openSegment(dir, baseOffset, "", c)
+}
+
+// segmentPath returns the path of one of the segment's files, which are named {baseOffset}{ext}.
+func segmentPath(dir string, baseOffset uint64, ext string) string {
+	return path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ext))
+}
+
+// openSegment opens the segment's files with the suffix added to their names, which lets the cleaner write a copy of a segment next to it.
+func openSegment(dir string, baseOffset uint64, suffix string, c Config) (*segment, error) {
 	s := &segment{
 		baseOffset: baseOffset,
 		config:     c,
 	}
 	var err error
 
-	storeFile, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	storeFile, err := os.OpenFile(segmentPath(dir, baseOffset, ".store"+suffix), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, err
 	}
@@ -32,7 +65,7 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
-	indexFile, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")), os.O_RDWR|os.O_CREATE, 0644)
+	indexFile, err := os.OpenFile(segmentPath(dir, baseOffset, ".index"+suffix), os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return nil, err
 	}
@@ -40,6 +73,11 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
+	// Repair whatever a crash left behind before we trust the index.
+	if s.recovery, err = s.recover(); err != nil {
+		return nil, err
+	}
+
 	if off, _, err := s.index.Read(-1); err != nil {
 		// If the index is empty, we set the next offset to the initial offset.
 		s.nextOffset = baseOffset
@@ -47,49 +85,286 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		// Otherwise, we set the next offset to the offset of the last index entry.
 		s.nextOffset = baseOffset + uint64(off) + 1
 	}
+
+	// Segments written before records had timestamps won't have a time index yet, so we create an empty one.
+	timeIndexFile, err := os.OpenFile(segmentPath(dir, baseOffset, ".timeindex"+suffix), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if s.timeIndex, err = newTimeIndex(timeIndexFile); err != nil {
+		return nil, err
+	}
+	if err = s.timeIndex.Truncate(uint32(s.nextOffset - baseOffset)); err != nil {
+		return nil, err
+	}
+	// The time index is sparse, so the records after its last entry are scanned to find the newest timestamp.
+	s.timeIndexPos = s.store.size
+	last, _ := s.timeIndex.Last()
+	s.maxTimestamp = last.timestamp
+	err = s.forEachFrom(last.offset, func(record *api.Record) error {
+		if record.Timestamp > s.maxTimestamp {
+			s.maxTimestamp = record.Timestamp
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	// The record offset is set to the next offset
-	curr := s.nextOffset
-	record.Offset = curr
+	record.Offset = s.nextOffset
+	// Stamp the record with the time it was appended, so consumers can find records by time.
+	stamp(record)
+	return s.append(record)
+}
+
+// stamp sets the timestamp of the records that don't have one yet to now.
+// Replicated records are stamped once by the leader before they go through Raft, so every server keeps the same timestamps, including ones restored from a snapshot.
+func stamp(records ...*api.Record) {
+	now := time.Now().UnixNano()
+	for _, record := range records {
+		if record.Timestamp == 0 {
+			record.Timestamp = now
+		}
+	}
+}
 
+// append writes the record at its own offset and with its own timestamp. The offset must not be before the segment's next offset.
+// Compaction uses this to rewrite records without changing them.
+func (s *segment) append(record *api.Record) (offset uint64, err error) {
 	p, err := proto.Marshal(record)
 	if err != nil {
 		return 0, err
 	}
+	return record.Offset, s.write(p, record)
+}
+
+// AppendBatch appends the records as a single frame compressed with the codec. The caller must check the segment has the capacity for them.
+func (s *segment) AppendBatch(records []*api.Record, codec api.Codec) (offset uint64, err error) {
+	stamp(records...)
+	for i, record := range records {
+		record.Offset = s.nextOffset + uint64(i)
+	}
+	return s.nextOffset, s.appendBatch(records, codec)
+}
+
+// appendBatch writes the records as a single frame compressed with the codec, keeping their offsets and timestamps.
+func (s *segment) appendBatch(records []*api.Record, codec api.Codec) error {
+	batch, err := api.NewRecordBatch(codec, records)
+	if err != nil {
+		return err
+	}
+	b, err := proto.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	return s.write(append([]byte{batchMarker}, b...), records...)
+}
+
+// write appends the frame to the store and adds an index entry pointing at it for each of its records.
+func (s *segment) write(p []byte, records ...*api.Record) error {
 	_, pos, err := s.store.Append(p)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	// Index offsets are relative to the base offset of the segment
-	offset = s.nextOffset - uint64(s.baseOffset)
-	if err = s.index.Write(uint32(offset), pos); err != nil {
-		return 0, err
+	for _, record := range records {
+		// Index offsets are relative to the base offset of the segment
+		offset := uint32(record.Offset - s.baseOffset)
+		if err = s.index.Write(offset, pos); err != nil {
+			return err
+		}
+		if record.Timestamp > s.maxTimestamp {
+			s.maxTimestamp = record.Timestamp
+		}
+		if len(s.timeIndex.entries) == 0 || pos-s.timeIndexPos >= timeIndexInterval {
+			if err = s.timeIndex.Write(s.maxTimestamp, offset); err != nil {
+				return err
+			}
+			s.timeIndexPos = pos
+		}
+		// Increment the next offset
+		s.nextOffset = record.Offset + 1
 	}
-	// Increment the next offset
-	s.nextOffset++
-	return curr, nil
+	return nil
 }
 
+// capacity returns how many more records fit in the segment's index.
+func (s *segment) capacity() int {
+	return int((uint64(len(s.index.mmap)) - s.index.size.Load()) / entWidth)
+}
+
+// Read returns the record at the offset. If the record was compacted away, it returns the next record in the segment instead.
 func (s *segment) Read(off uint64) (*api.Record, error) {
+	// The offset is past what a relative offset can reach, so it can't be in this segment.
+	if off-s.baseOffset > math.MaxUint32 {
+		return nil, io.EOF
+	}
 	// We need to convert the absolute offset to a relative offset that we can use for the index.
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	rel := uint32(off - s.baseOffset)
+	// Offsets are only sparse once the segment has been compacted, so we try the entry at the offset's position first.
+	out, pos, err := s.index.Read(int64(rel))
+	if err != nil || out != rel {
+		if _, out, pos, err = s.index.Find(rel); err != nil {
+			return nil, err
+		}
+	}
+	return s.readAt(pos, s.baseOffset+uint64(out))
+}
+
+// readShared is Read for readers that don't hold the log's lock. It returns false without reading if the segment was closed or is being truncated.
+func (s *segment) readShared(off uint64) (*api.Record, bool, error) {
+	if !s.readMu.TryRLock() {
+		return nil, false, nil
+	}
+	defer s.readMu.RUnlock()
+	if s.closed {
+		return nil, false, nil
+	}
+	record, err := s.Read(off)
+	return record, true, err
+}
+
+// readAt reads the record with the offset from the frame stored at the position in the store.
+func (s *segment) readAt(pos uint64, off uint64) (*api.Record, error) {
+	records, err := s.readFrame(pos)
+	var corrupt api.ErrCorruptRecord
+	if errors.As(err, &corrupt) {
+		// The store only knows where the record is, so we add the offset that was asked for.
+		corrupt.Offset = off
+		return nil, corrupt
+	}
 	if err != nil {
 		return nil, err
 	}
+	// Frames written before batches only hold a single record.
+	if len(records) == 1 {
+		return records[0], nil
+	}
+	for _, record := range records {
+		if record.Offset == off {
+			return record, nil
+		}
+	}
+	return nil, fmt.Errorf("record %d not found in batch at position %d", off, pos)
+}
+
+// readFrame returns the records in the frame at the position.
+// Consumers usually read every record in a batch one after the other, so the last batch is cached rather than decompressed for every record.
+// The cached records are shared between readers, so they must not be modified.
+func (s *segment) readFrame(pos uint64) ([]*api.Record, error) {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	if s.cached != nil && s.cachedPos == pos {
+		return s.cached, nil
+	}
 	p, err := s.store.Read(pos)
 	if err != nil {
 		return nil, err
 	}
+	records, err := decodeFrame(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > 1 {
+		s.cached, s.cachedPos = records, pos
+	}
+	return records, nil
+}
+
+// batchMarker starts frames that hold a compressed batch of records. A single record is stored as its protobuf encoding, which never starts with a zero byte because field numbers start at 1.
+const batchMarker byte = 0
+
+// decodeFrame returns the records stored in a frame of the store.
+func decodeFrame(p []byte) ([]*api.Record, error) {
+	if len(p) > 0 && p[0] == batchMarker {
+		batch := &api.RecordBatch{}
+		if err := proto.Unmarshal(p[1:], batch); err != nil {
+			return nil, err
+		}
+		return batch.Decode()
+	}
 	record := &api.Record{}
-	err = proto.Unmarshal(p, record)
-	return record, err
+	if err := proto.Unmarshal(p, record); err != nil {
+		return nil, err
+	}
+	return []*api.Record{record}, nil
+}
+
+// forEach calls fn with every record in the segment in offset order.
+func (s *segment) forEach(fn func(record *api.Record) error) error {
+	return s.forEachFrom(0, fn)
+}
+
+// forEachFrom calls fn with every record in the segment at or after the relative offset in offset order.
+func (s *segment) forEachFrom(off uint32, fn func(record *api.Record) error) error {
+	start, _, _, err := s.index.Find(off)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for entry := start; uint64(entry)*entWidth < s.index.size.Load(); entry++ {
+		out, pos, err := s.index.Read(entry)
+		if err != nil {
+			return err
+		}
+		record, err := s.readAt(pos, s.baseOffset+uint64(out))
+		if err != nil {
+			return err
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// modTime returns when the segment was last written to.
+func (s *segment) modTime() (time.Time, error) {
+	fi, err := s.store.File.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// offsetForTime returns the offset of the first record in the segment appended at or after the timestamp.
+// It returns io.EOF if every record in the segment is older.
+func (s *segment) offsetForTime(timestamp int64) (uint64, error) {
+	if s.maxTimestamp < timestamp {
+		return 0, io.EOF
+	}
+	offset, found := uint64(0), false
+	err := s.forEachFrom(s.timeIndex.Lookup(timestamp), func(record *api.Record) error {
+		if record.Timestamp >= timestamp {
+			offset, found = record.Offset, true
+			return errStop
+		}
+		return nil
+	})
+	if err != nil && err != errStop {
+		return 0, err
+	}
+	if !found {
+		return 0, io.EOF
+	}
+	return offset, nil
+}
+
+// errStop is returned from a forEach callback to stop iterating early.
+var errStop = errors.New("stop")
+
+// size returns the number of bytes the segment's store and index take up on disk.
+func (s *segment) size() uint64 {
+	return s.store.size + s.index.size.Load()
 }
 
 func (s *segment) Remove() error {
-	if err := s.index.Close(); err != nil {
+	if err := s.Close(); err != nil {
 		return err
 	}
 	if err := os.Remove(s.store.Name()); err != nil {
@@ -98,21 +373,73 @@ func (s *segment) Remove() error {
 	if err := os.Remove(s.index.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
 	return nil
 }
 
+// Close closes the segment's files once the readers using it are done. Closing it again does nothing.
 func (s *segment) Close() error {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
 	if err := s.index.Close(); err != nil {
 		return err
 	}
 	if err := s.store.Close(); err != nil {
 		return err
 	}
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// truncate drops the record at the given offset and every record after it from the segment.
+func (s *segment) truncate(off uint64) error {
+	// Readers that don't hold the log's lock could see the segment half truncated, so we wait for them and keep them out until we're done.
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	entry, _, pos, err := s.index.Find(uint32(off - s.baseOffset))
+	if err != nil {
+		return err
+	}
+	records, err := s.readFrame(pos)
+	if err != nil {
+		return err
+	}
+	// A batch is a single frame, so the records before the offset that share its frame have to be written again.
+	var keep []*api.Record
+	for _, record := range records {
+		if record.Offset < off {
+			keep = append(keep, record)
+		}
+	}
+	if err = s.store.Truncate(pos); err != nil {
+		return err
+	}
+	s.index.size.Store(uint64(entry-int64(len(keep))) * entWidth)
+	s.cacheMu.Lock()
+	s.cached = nil
+	s.cacheMu.Unlock()
+	if err = s.timeIndex.Truncate(uint32(off - s.baseOffset)); err != nil {
+		return err
+	}
+	if len(keep) > 0 {
+		if err = s.appendBatch(keep, s.config.Segment.Codec); err != nil {
+			return err
+		}
+	}
+	s.nextOffset = off
 	return nil
 }
 
 func (s *segment) IsMaxed() bool {
-	return s.store.size >= s.config.Segment.MaxStoreBytes || s.index.size >= s.config.Segment.MaxIndexBytes
+	return s.store.size >= s.config.Segment.MaxStoreBytes || s.index.size.Load() >= s.config.Segment.MaxIndexBytes
 }
 
 func nearestMultiple(j, k uint64) uint64 {
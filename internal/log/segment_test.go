@@ -7,6 +7,8 @@ import (
 
 	api "github.com/MartinMinkov/proglog/api/v1"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestSegment(t *testing.T) {
@@ -52,3 +54,54 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmentKeyAndHeaders(t *testing.T) {
+	dir, _ := os.MkdirTemp(os.TempDir(), "segment_headers_test")
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+
+	want := &api.Record{
+		Value: []byte("hello world"),
+		Key:   []byte("user-1"),
+		Headers: []*api.Header{
+			{Key: "trace-id", Value: []byte("abc")},
+			{Key: "content-type", Value: []byte("text/plain")},
+			// Header keys can repeat, so the order is kept.
+			{Key: "trace-id", Value: []byte("def")},
+		},
+	}
+	off, err := s.Append(want)
+	require.NoError(t, err)
+
+	// Segments written before records had keys and headers only have the value and offset.
+	legacy := protowire.AppendTag(nil, 1, protowire.BytesType)
+	legacy = protowire.AppendBytes(legacy, []byte("legacy"))
+	legacy = protowire.AppendTag(legacy, 2, protowire.VarintType)
+	legacy = protowire.AppendVarint(legacy, 1)
+	_, pos, err := s.store.Append(legacy)
+	require.NoError(t, err)
+	require.NoError(t, s.index.Write(1, pos))
+	s.nextOffset++
+	require.NoError(t, s.Close())
+
+	// Reopen the segment so the records are read back from disk.
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	got, err := s.Read(off)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(want, got))
+
+	got, err = s.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("legacy"), got.Value)
+	require.Equal(t, uint64(1), got.Offset)
+	require.Nil(t, got.Key)
+	require.Empty(t, got.Headers)
+}
@@ -2,9 +2,15 @@ package log
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
 )
 
 var (
@@ -13,6 +19,20 @@ var (
 
 const (
 	lenWidth = 8
+	// The width of the checksum that follows the length of checksummed records.
+	crcWidth = 4
+	// checksummed is set in the length of records written with a checksum. Records written before checksums were added don't have it, so we can still read them.
+	checksummed uint64 = 1 << 63
+	// storeHeaderWidth is the width of the header stores start with: the magic followed by the format version.
+	storeHeaderWidth = 8
+	// storeVersion is the format of the stores we write, where every record has a checksum.
+	storeVersion uint32 = 1
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+	// storeMagic starts every store created since records got checksums. Stores without it were written before and can start with records that don't have one.
+	storeMagic = []byte("PLOG")
 )
 
 /**
@@ -24,6 +44,11 @@ type store struct {
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
+	// start is the position of the first record, after the header if the store has one.
+	start uint64
+	// checkedFrom is the position from which every record has to have a checksum.
+	// A single flipped bit would make a record look like one written before checksums were added, so only the records in front of the first checksummed one in a store without a header can do without.
+	checkedFrom uint64
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -31,20 +56,74 @@ func newStore(f *os.File) (*store, error) {
 	if err != nil {
 		return nil, err
 	}
-	size := uint64(fi.Size())
-	return &store{
+	s := &store{
 		File: f,
-		size: size,
+		size: uint64(fi.Size()),
 		buf:  bufio.NewWriter(f),
-	}, nil
+	}
+	header := make([]byte, min(s.size, storeHeaderWidth))
+	if _, err = f.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(storeMagic, header[:min(len(header), len(storeMagic))]) && s.size < storeHeaderWidth:
+		// A new store, or one whose header was torn by a crash before its first record made it. Append writes the header.
+		s.start = storeHeaderWidth
+	case bytes.HasPrefix(header, storeMagic):
+		if version := enc.Uint32(header[len(storeMagic):]); version != storeVersion {
+			return nil, fmt.Errorf("%s: unsupported store version %d", f.Name(), version)
+		}
+		s.start = storeHeaderWidth
+	default:
+		// The store was created before records got checksums, so the records up to the first checksummed one may not have one.
+		s.start = 0
+		if s.checkedFrom, err = s.firstChecksummed(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	s.checkedFrom = s.start
+	return s, nil
+}
+
+// firstChecksummed returns the position of the first record with a checksum in a store without a header, or where the records written without one end.
+func (s *store) firstChecksummed() (uint64, error) {
+	header := make([]byte, lenWidth)
+	var pos uint64
+	for pos+lenWidth <= s.size {
+		if _, err := s.File.ReadAt(header, int64(pos)); err != nil {
+			return 0, err
+		}
+		n := enc.Uint64(header)
+		// A torn record is truncated by recovery, and whatever is appended in its place has a checksum.
+		if n&checksummed != 0 || n > s.size-pos-lenWidth {
+			return pos, nil
+		}
+		pos += lenWidth + n
+	}
+	return pos, nil
 }
 
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	// A new store gets its header with its first record. A crash may have left part of it behind, which we write over.
+	if s.size < s.start {
+		if err := s.File.Truncate(0); err != nil {
+			return 0, 0, err
+		}
+		header := make([]byte, storeHeaderWidth)
+		copy(header, storeMagic)
+		enc.PutUint32(header[len(storeMagic):], storeVersion)
+		if _, err := s.buf.Write(header); err != nil {
+			return 0, 0, err
+		}
+		s.size = storeHeaderWidth
+	}
 	pos = s.size
 	// We write the length of the payload to the buffer in big endian format. This lets us efficiently read the payload from the file when we need to later.
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	// The length is followed by a checksum of the payload, so we can tell if it was torn or corrupted when we read it back.
+	if _, err := s.buf.Write(frameHeader(p)); err != nil {
 		return 0, 0, err
 	}
 	// Write the payload to the buffer.
@@ -52,33 +131,141 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	if err != nil {
 		return 0, 0, err
 	}
-	// Add the length of the payload to the size of the file.
-	w += lenWidth
+	// Add the length of the header to the size of the file.
+	w += lenWidth + crcWidth
 	// Update the size of the file.
 	s.size += uint64(w)
 	return uint64(w), pos, nil
 }
 
+// frameHeader returns the header written in front of the payload: its length with the checksummed bit set, followed by its checksum.
+func frameHeader(p []byte) []byte {
+	header := make([]byte, lenWidth+crcWidth)
+	enc.PutUint64(header[:lenWidth], uint64(len(p))|checksummed)
+	enc.PutUint32(header[lenWidth:], crc32.Checksum(p, crcTable))
+	return header
+}
+
+// Read returns the payload of the record at the position. It returns an ErrCorruptRecord if the record doesn't fit in the store or its checksum doesn't match.
 func (s *store) Read(pos uint64) ([]byte, error) {
+	p, _, err := s.readRecord(pos)
+	return p, err
+}
+
+// readRecord returns the payload of the record at the position, and how many bytes the record takes up in the store including its header.
+func (s *store) readRecord(pos uint64) ([]byte, uint64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	// We need to flush the buffer before reading from the file, to ensure that the data is written to disk.
 	if err := s.buf.Flush(); err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	if pos+lenWidth > s.size {
+		return nil, 0, io.EOF
+	}
+	if pos < s.start {
+		return nil, 0, api.ErrCorruptRecord{Position: pos, Reason: "position is inside the store header"}
 	}
 	// Construct a buffer to read the length of the payload from the file.
 	size := make([]byte, lenWidth)
 	// We read the length of the payload at the given position in the file
 	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	n := enc.Uint64(size)
+	start := pos + lenWidth
+	if n&checksummed != 0 {
+		n &^= checksummed
+		start += crcWidth
+	} else if pos >= s.checkedFrom {
+		return nil, 0, api.ErrCorruptRecord{Position: pos, Reason: "record is missing its checksum"}
 	}
+	// A corrupt length would have us allocate and read whatever it says, so we check it against what is actually in the store first.
+	if start > s.size || n > s.size-start {
+		return nil, 0, api.ErrCorruptRecord{Position: pos, Reason: "record extends past the end of the store"}
+	}
+	width := start - pos + n
 	// We construct a buffer to read the payload data from the file.
-	b := make([]byte, enc.Uint64(size))
-	// We read the payload of the data where at the position plus the length of the payload length header.
+	b := make([]byte, width-lenWidth)
+	// We read the checksum and payload of the data where at the position plus the length of the payload length header.
 	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+		return nil, 0, err
+	}
+	if start == pos+lenWidth {
+		return b, width, nil
+	}
+	if crc32.Checksum(b[crcWidth:], crcTable) != enc.Uint32(b[:crcWidth]) {
+		return nil, 0, api.ErrCorruptRecord{Position: pos, Reason: "checksum mismatch"}
+	}
+	return b[crcWidth:], width, nil
+}
+
+/**
+ * frameReader reads the records in the stores up to the sizes they had when it was created, e.g. for a snapshot.
+ * Every record is read as a checksummed frame whatever the store it's in holds it as, so the copy doesn't depend on the stores' formats.
+ */
+type frameReader struct {
+	stores []*store
+	sizes  []uint64
+	pos    uint64
+	buf    []byte
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if len(r.stores) == 0 {
+			return 0, io.EOF
+		}
+		s := r.stores[0]
+		r.pos = max(r.pos, s.start)
+		if r.pos >= r.sizes[0] {
+			r.stores, r.sizes, r.pos = r.stores[1:], r.sizes[1:], 0
+			continue
+		}
+		payload, width, err := s.readRecord(r.pos)
+		if err != nil {
+			return 0, err
+		}
+		r.pos += width
+		r.buf = append(frameHeader(payload), payload...)
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// readStoreFrame reads a record's payload from a copy of the stores made by a frameReader, checking its checksum.
+func readStoreFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, lenWidth)
+	if _, err := io.ReadFull(r, header); err != nil {
 		return nil, err
 	}
-	return b, nil
+	n := enc.Uint64(header)
+	// Copies only ever hold checksummed frames, so one without is corrupt.
+	if n&checksummed == 0 {
+		return nil, api.ErrCorruptRecord{Reason: "frame is missing its checksum"}
+	}
+	n &^= checksummed
+	crc := make([]byte, crcWidth)
+	if _, err := io.ReadFull(r, crc); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	// We don't know how big the copy is, so we read the payload in chunks rather than trusting the length with a single allocation.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+		// The header was there, so running out of data means the copy was cut short.
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.Checksum(buf.Bytes(), crcTable) != enc.Uint32(crc) {
+		return nil, api.ErrCorruptRecord{Reason: "checksum mismatch"}
+	}
+	return buf.Bytes(), nil
 }
 
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
@@ -90,6 +277,37 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
+// Truncate discards everything in the store from the given position onwards.
+func (s *store) Truncate(pos uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(pos)); err != nil {
+		return err
+	}
+	s.size = pos
+	// Whatever is appended in place of the records we dropped has a checksum. A store left empty gets a header, like a new one.
+	s.checkedFrom = min(s.checkedFrom, pos)
+	if pos == 0 {
+		s.start, s.checkedFrom = storeHeaderWidth, storeHeaderWidth
+	}
+	return nil
+}
+
+// Sync writes the buffer to the file and fsyncs it, so every record appended so far survives a crash.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	err := s.buf.Flush()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// The fsync can take a while, so we don't hold the lock and block readers during it.
+	return s.File.Sync()
+}
+
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -97,6 +315,10 @@ func (s *store) Close() error {
 	if err != nil {
 		return err
 	}
+	// Sealed segments are never written to again, so we make sure they are on disk before we let go of the file.
+	if err = s.File.Sync(); err != nil {
+		return err
+	}
 	return s.File.Close()
 }
 
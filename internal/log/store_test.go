@@ -4,12 +4,15 @@ import (
 	"os"
 	"testing"
 
+	api "github.com/MartinMinkov/proglog/api/v1"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
 	write = []byte("hello, world")
-	width = uint64(len(write)) + lenWidth
+	width = uint64(len(write)) + lenWidth + crcWidth
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -34,13 +37,13 @@ func testAppend(t *testing.T, s *store) {
 	for i := uint64(1); i < 4; i++ {
 		n, pos, err := s.Append(write)
 		require.NoError(t, err)
-		require.Equal(t, pos+n, width*i)
+		require.Equal(t, pos+n, storeHeaderWidth+width*i)
 	}
 }
 
 func testRead(t *testing.T, s *store) {
 	t.Helper()
-	var pos uint64
+	pos := uint64(storeHeaderWidth)
 	for i := uint64(1); i < 4; i++ {
 		read, err := s.Read(pos)
 		require.NoError(t, err)
@@ -51,14 +54,16 @@ func testRead(t *testing.T, s *store) {
 
 func testReadAt(t *testing.T, s *store) {
 	t.Helper()
-	for i, off := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, lenWidth)
+	for i, off := uint64(1), int64(storeHeaderWidth); i < 4; i++ {
+		b := make([]byte, lenWidth+crcWidth)
 		n, err := s.ReadAt(b, off)
 		require.NoError(t, err)
-		require.Equal(t, lenWidth, n)
+		require.Equal(t, lenWidth+crcWidth, n)
 		off += int64(n)
 
-		size := enc.Uint64(b)
+		size := enc.Uint64(b[:lenWidth])
+		require.NotZero(t, size&checksummed)
+		size &^= checksummed
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, off)
 		require.NoError(t, err)
@@ -88,6 +93,105 @@ func TestStoreClose(t *testing.T) {
 
 }
 
+func TestStoreCorruption(t *testing.T) {
+	for scenario, corrupt := range map[string]func(t *testing.T, f *os.File){
+		"flipped payload bit fails the checksum": func(t *testing.T, f *os.File) {
+			_, err := f.WriteAt([]byte{write[0] ^ 1}, storeHeaderWidth+lenWidth+crcWidth)
+			require.NoError(t, err)
+		},
+		"corrupt length is bounded by the store size": func(t *testing.T, f *os.File) {
+			b := make([]byte, lenWidth)
+			enc.PutUint64(b, checksummed|1<<40)
+			_, err := f.WriteAt(b, storeHeaderWidth)
+			require.NoError(t, err)
+		},
+		"flipped checksummed bit doesn't pass as a legacy record": func(t *testing.T, f *os.File) {
+			b := make([]byte, lenWidth)
+			enc.PutUint64(b, uint64(len(write)))
+			_, err := f.WriteAt(b, storeHeaderWidth)
+			require.NoError(t, err)
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			f, err := os.CreateTemp(os.TempDir(), "store_corruption_test")
+			require.NoError(t, err)
+			defer os.Remove(f.Name())
+			s, err := newStore(f)
+			require.NoError(t, err)
+			_, pos, err := s.Append(write)
+			require.NoError(t, err)
+			require.NoError(t, s.buf.Flush())
+
+			corrupt(t, f)
+
+			_, err = s.Read(pos)
+			var want api.ErrCorruptRecord
+			require.ErrorAs(t, err, &want)
+			require.Equal(t, codes.DataLoss, status.Code(err))
+		})
+	}
+}
+
+func TestStoreReadLegacy(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "store_legacy_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// Records written before checksums were added only have the length in front of them.
+	b := make([]byte, lenWidth)
+	enc.PutUint64(b, uint64(len(write)))
+	_, err = f.Write(append(b, write...))
+	require.NoError(t, err)
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	read, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+
+	// Records appended to the store have checksums, and from the first of them on every record needs one, even after the store is opened again.
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, s.buf.Flush())
+	enc.PutUint64(b, uint64(len(write)))
+	_, err = f.WriteAt(b, int64(pos))
+	require.NoError(t, err)
+	for _, s := range []*store{s, reopenStore(t, f)} {
+		read, err = s.Read(0)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+		_, err = s.Read(pos)
+		var want api.ErrCorruptRecord
+		require.ErrorAs(t, err, &want)
+	}
+}
+
+func TestStoreUnknownVersion(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "store_version_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	header := make([]byte, storeHeaderWidth)
+	copy(header, storeMagic)
+	enc.PutUint32(header[len(storeMagic):], storeVersion+1)
+	_, err = f.Write(header)
+	require.NoError(t, err)
+
+	_, err = newStore(f)
+	require.Error(t, err)
+}
+
+func reopenStore(t *testing.T, f *os.File) *store {
+	t.Helper()
+	f, err := os.OpenFile(f.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	s, err := newStore(f)
+	require.NoError(t, err)
+	return s
+}
+
 func openFile(name string) (*os.File, uint64, error) {
 	f, err := os.OpenFile(name, os.O_RDWR, 0600)
 	if err != nil {
@@ -0,0 +1,133 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+)
+
+// ErrClosed ends the subscriptions of a log that was closed.
+var ErrClosed = errors.New("log closed")
+
+/**
+ * Subscription delivers the records of a log from an offset onwards: first the ones already in the log, then new ones as they are appended.
+ * Records are only read from the log when the subscriber is ready for them, so a slow subscriber never holds up appends or buffers records in memory.
+ */
+type Subscription struct {
+	records chan *api.Record
+	err     error
+
+	// truncatedFrom is the lowest offset the log was truncated from since the subscription last moved on, or math.MaxUint64 if it wasn't.
+	mu            sync.Mutex
+	truncatedFrom uint64
+}
+
+// Records returns the channel the records are delivered on. It is closed when the subscription ends, after which Err says why.
+func (s *Subscription) Records() <-chan *api.Record {
+	return s.records
+}
+
+/**
+ * Err returns why the subscription ended, once Records is closed. It's the context's error if it was cancelled, ErrClosed if the log was closed,
+ * and an ErrOffsetOutOfRange if the records the subscriber was about to read were removed from the start of the log.
+ */
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// truncated tells the subscription the log was truncated from the offset. The caller must hold the log's lock.
+func (s *Subscription) truncated(offset uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.truncatedFrom = min(s.truncatedFrom, offset)
+}
+
+// position returns the offset to read next, which moves back to where the log was truncated if records at or after it were already delivered.
+func (s *Subscription) position(next uint64) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next = min(next, s.truncatedFrom)
+	s.truncatedFrom = math.MaxUint64
+	return next
+}
+
+/**
+ * Subscribe tails the log from the offset until the context is cancelled or the log is closed.
+ * Segment rollovers and compacted gaps are followed like Read does. If the log is truncated behind the subscription, it carries on from where
+ * the log was truncated, so the records appended in place of the removed ones are delivered too. The offsets going back tells the subscriber earlier records were replaced.
+ * It returns ErrClosed if the log is already closed.
+ */
+func (l *Log) Subscribe(ctx context.Context, from uint64) (*Subscription, error) {
+	s := &Subscription{
+		records:       make(chan *api.Record),
+		truncatedFrom: math.MaxUint64,
+	}
+	// Close closes the channel while holding the lock, so once we've checked it under the lock the subscription is sure to be ended by it.
+	l.mu.Lock()
+	select {
+	case <-l.closed:
+		l.mu.Unlock()
+		return nil, ErrClosed
+	default:
+	}
+	if l.subscriptions == nil {
+		l.subscriptions = make(map[*Subscription]struct{})
+	}
+	l.subscriptions[s] = struct{}{}
+	l.mu.Unlock()
+
+	go func() {
+		s.err = l.deliver(ctx, s, from)
+		l.mu.Lock()
+		delete(l.subscriptions, s)
+		l.mu.Unlock()
+		close(s.records)
+	}()
+	return s, nil
+}
+
+// deliver sends the records from the offset onwards to the subscription until it ends, and returns why it ended.
+func (l *Log) deliver(ctx context.Context, s *Subscription, off uint64) error {
+	for {
+		off = s.position(off)
+		// We take the channel before reading, so we can't miss an append that happens in between.
+		l.mu.RLock()
+		lowest, appended := l.segments[0].baseOffset, l.appended
+		l.mu.RUnlock()
+		if off < lowest {
+			return api.ErrOffsetOutOfRange{Offset: off}
+		}
+		record, err := l.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			// We've caught up, so we wait for the next append, or a truncation that moves us back.
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-l.closed:
+				return ErrClosed
+			case <-appended:
+			}
+			continue
+		}
+		if err != nil {
+			select {
+			case <-l.closed:
+				return ErrClosed
+			default:
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-l.closed:
+			return ErrClosed
+		case s.records <- record:
+		}
+		// Compacted logs skip over removed offsets, so we continue after the record we delivered.
+		off = record.Offset + 1
+	}
+}
@@ -0,0 +1,172 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, log *Log,
+	){
+		"existing then new records across segments": testSubscribeTail,
+		"slow subscribers don't hold up appends":    testSubscribeBackpressure,
+		"cancelling the context ends it":            testSubscribeCancel,
+		"closing the log ends it":                   testSubscribeClose,
+		"truncated records are replaced":            testSubscribeTruncateFrom,
+		"removed records end it":                    testSubscribeRemoved,
+		"subscribing to a closed log fails":         testSubscribeClosed,
+		"resetting the log doesn't end it":          testSubscribeReset,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp(os.TempDir(), "subscribe_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			// A few records fill a segment, so subscriptions cross rollovers.
+			c.Segment.MaxIndexBytes = entWidth * 3
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			fn(t, log)
+		})
+	}
+}
+
+func appendValues(t *testing.T, log *Log, values ...string) {
+	t.Helper()
+	for _, value := range values {
+		_, err := log.Append(&api.Record{Value: []byte(value)})
+		require.NoError(t, err)
+	}
+}
+
+func subscribe(t *testing.T, log *Log, ctx context.Context, from uint64) *Subscription {
+	t.Helper()
+	sub, err := log.Subscribe(ctx, from)
+	require.NoError(t, err)
+	return sub
+}
+
+// next returns the next record delivered to the subscription, failing if it takes too long.
+func next(t *testing.T, sub *Subscription) *api.Record {
+	t.Helper()
+	select {
+	case record, ok := <-sub.Records():
+		require.True(t, ok, "subscription ended: %v", sub.Err())
+		return record
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a record")
+		return nil
+	}
+}
+
+// ended waits for the subscription to end and returns why.
+func ended(t *testing.T, sub *Subscription) error {
+	t.Helper()
+	for {
+		select {
+		case _, ok := <-sub.Records():
+			if !ok {
+				return sub.Err()
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the subscription to end")
+		}
+	}
+}
+
+func testSubscribeTail(t *testing.T, log *Log) {
+	appendValues(t, log, "0", "1", "2", "3")
+	sub := subscribe(t, log, context.Background(), 1)
+	for off := uint64(1); off < 4; off++ {
+		require.Equal(t, off, next(t, sub).Offset)
+	}
+	// New records are delivered as they're appended, including the ones in segments that didn't exist when we subscribed.
+	for off := uint64(4); off < 10; off++ {
+		go log.Append(&api.Record{Value: []byte(fmt.Sprint(off))})
+		record := next(t, sub)
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, []byte(fmt.Sprint(off)), record.Value)
+	}
+	require.Greater(t, len(log.segments), 3)
+}
+
+func testSubscribeBackpressure(t *testing.T, log *Log) {
+	sub := subscribe(t, log, context.Background(), 0)
+	records := 100
+	for i := 0; i < records; i++ {
+		appendValues(t, log, fmt.Sprint(i))
+	}
+	for off := 0; off < records; off++ {
+		require.Equal(t, uint64(off), next(t, sub).Offset)
+	}
+}
+
+func testSubscribeCancel(t *testing.T, log *Log) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := subscribe(t, log, ctx, 0)
+	appendValues(t, log, "0")
+	require.Equal(t, uint64(0), next(t, sub).Offset)
+	cancel()
+	require.ErrorIs(t, ended(t, sub), context.Canceled)
+	log.mu.RLock()
+	defer log.mu.RUnlock()
+	require.Empty(t, log.subscriptions)
+}
+
+func testSubscribeClose(t *testing.T, log *Log) {
+	sub := subscribe(t, log, context.Background(), 0)
+	require.NoError(t, log.Close())
+	require.ErrorIs(t, ended(t, sub), ErrClosed)
+}
+
+func testSubscribeTruncateFrom(t *testing.T, log *Log) {
+	appendValues(t, log, "0", "1", "2", "3", "4")
+	sub := subscribe(t, log, context.Background(), 0)
+	for off := uint64(0); off < 5; off++ {
+		require.Equal(t, off, next(t, sub).Offset)
+	}
+	// The subscriber already had the records from 2 onwards, so it goes back for the ones appended in their place.
+	require.NoError(t, log.truncateFrom(2))
+	appendValues(t, log, "replaced 2", "replaced 3")
+	for off := uint64(2); off < 4; off++ {
+		record := next(t, sub)
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("replaced %d", off)), record.Value)
+	}
+}
+
+func testSubscribeRemoved(t *testing.T, log *Log) {
+	appendValues(t, log, "0", "1", "2", "3", "4", "5", "6")
+	sub := subscribe(t, log, context.Background(), 0)
+	require.Equal(t, uint64(0), next(t, sub).Offset)
+	// The subscriber fell behind and the records it was about to read were removed.
+	require.NoError(t, log.Truncate(4))
+	_, ok := ended(t, sub).(api.ErrOffsetOutOfRange)
+	require.True(t, ok)
+}
+
+func testSubscribeClosed(t *testing.T, log *Log) {
+	require.NoError(t, log.Close())
+	_, err := log.Subscribe(context.Background(), 0)
+	require.ErrorIs(t, err, ErrClosed)
+}
+
+func testSubscribeReset(t *testing.T, log *Log) {
+	appendValues(t, log, "0")
+	sub := subscribe(t, log, context.Background(), 0)
+	require.Equal(t, uint64(0), next(t, sub).Offset)
+	// The log starts again, so the subscription carries on with the records appended to it.
+	require.NoError(t, log.Reset())
+	appendValues(t, log, "after reset")
+	record := next(t, sub)
+	require.Equal(t, uint64(0), record.Offset)
+	require.Equal(t, []byte("after reset"), record.Value)
+}
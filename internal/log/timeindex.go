@@ -0,0 +1,121 @@
+package log
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+var (
+	// The width of the timestamp in a time index entry.
+	timestampWidth uint64 = 8
+	// The width of a time index entry, the timestamp followed by the relative offset of the record.
+	timeEntWidth = timestampWidth + offWidth
+)
+
+// timeIndexInterval is how many bytes are written to the store between two time index entries.
+const timeIndexInterval = 4096
+
+/**
+ * timeIndex is a sparse index from append timestamps to relative offsets in a segment.
+ * An entry is only written every timeIndexInterval bytes of the store. Its timestamp is the newest timestamp in the segment so far, so every record before the entry's offset is no newer than it even if the clock went backwards.
+ * Entries are only written when that timestamp moved forward, so they are always sorted by both timestamp and offset.
+ * Lookups find the closest entry before a timestamp and scan the segment's records from there.
+ * The entries are small enough to keep in memory, the file is only read when the segment is opened.
+ */
+type timeIndex struct {
+	file    *os.File
+	entries []timeEntry
+}
+
+type timeEntry struct {
+	timestamp int64
+	offset    uint32
+}
+
+func newTimeIndex(f *os.File) (*timeIndex, error) {
+	t := &timeIndex{file: f}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	// A crash can leave a partial entry at the end of the file, which we drop.
+	n := uint64(len(b)) / timeEntWidth
+	if err = f.Truncate(int64(n * timeEntWidth)); err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(0, io.SeekEnd); err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < n; i++ {
+		e := b[i*timeEntWidth : (i+1)*timeEntWidth]
+		t.entries = append(t.entries, timeEntry{
+			timestamp: int64(enc.Uint64(e[:timestampWidth])),
+			offset:    enc.Uint32(e[timestampWidth:]),
+		})
+	}
+	return t, nil
+}
+
+// Write adds an entry for the record at the relative offset, unless the timestamp is not after the last entry's.
+func (t *timeIndex) Write(timestamp int64, off uint32) error {
+	if len(t.entries) > 0 && timestamp <= t.entries[len(t.entries)-1].timestamp {
+		return nil
+	}
+	b := make([]byte, timeEntWidth)
+	enc.PutUint64(b[:timestampWidth], uint64(timestamp))
+	enc.PutUint32(b[timestampWidth:], off)
+	if _, err := t.file.Write(b); err != nil {
+		return err
+	}
+	t.entries = append(t.entries, timeEntry{timestamp: timestamp, offset: off})
+	return nil
+}
+
+// Lookup returns the relative offset to start scanning from for the first record at or after the timestamp.
+func (t *timeIndex) Lookup(timestamp int64) uint32 {
+	// Every record before the offset of the last entry older than the timestamp is older too.
+	i := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].timestamp >= timestamp
+	})
+	if i == 0 {
+		return 0
+	}
+	return t.entries[i-1].offset
+}
+
+// Last returns the last entry, which is where the segment's newest records start.
+func (t *timeIndex) Last() (timeEntry, bool) {
+	if len(t.entries) == 0 {
+		return timeEntry{}, false
+	}
+	return t.entries[len(t.entries)-1], true
+}
+
+// Truncate drops the entries at or after the relative offset.
+func (t *timeIndex) Truncate(off uint32) error {
+	n := sort.Search(len(t.entries), func(i int) bool {
+		return t.entries[i].offset >= off
+	})
+	size := int64(uint64(n) * timeEntWidth)
+	if err := t.file.Truncate(size); err != nil {
+		return err
+	}
+	// Truncating doesn't move the file offset, so we seek back to the end or the next entry would be written past a gap of zeroes.
+	if _, err := t.file.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	t.entries = t.entries[:n]
+	return nil
+}
+
+func (t *timeIndex) Close() error {
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+	return t.file.Close()
+}
+
+func (t *timeIndex) Name() string {
+	return t.file.Name()
+}
@@ -0,0 +1,60 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := os.CreateTemp(os.TempDir(), "timeindex_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	idx, err := newTimeIndex(f)
+	require.NoError(t, err)
+	_, ok := idx.Last()
+	require.False(t, ok)
+	// Lookups in an empty index scan the whole segment.
+	require.Equal(t, uint32(0), idx.Lookup(100))
+
+	require.NoError(t, idx.Write(100, 0))
+	require.NoError(t, idx.Write(200, 10))
+	// Timestamps that don't move forward are skipped, so the entries stay sorted.
+	require.NoError(t, idx.Write(150, 15))
+	require.NoError(t, idx.Write(300, 20))
+
+	require.Equal(t, uint32(0), idx.Lookup(50))
+	require.Equal(t, uint32(0), idx.Lookup(100))
+	require.Equal(t, uint32(0), idx.Lookup(150))
+	require.Equal(t, uint32(10), idx.Lookup(250))
+	require.Equal(t, uint32(20), idx.Lookup(400))
+
+	// The index should rebuild its entries from the file, dropping a partial entry left by a crash.
+	_, err = f.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, idx.Close())
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newTimeIndex(f)
+	require.NoError(t, err)
+	last, ok := idx.Last()
+	require.True(t, ok)
+	require.Equal(t, timeEntry{timestamp: 300, offset: 20}, last)
+
+	require.NoError(t, idx.Truncate(10))
+	last, ok = idx.Last()
+	require.True(t, ok)
+	require.Equal(t, timeEntry{timestamp: 100, offset: 0}, last)
+
+	// Entries written after truncating follow straight on from the ones that were kept.
+	require.NoError(t, idx.Write(400, 12))
+	require.NoError(t, idx.Close())
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	require.NoError(t, err)
+	idx, err = newTimeIndex(f)
+	require.NoError(t, err)
+	require.Equal(t, []timeEntry{{timestamp: 100, offset: 0}, {timestamp: 400, offset: 12}}, idx.entries)
+	require.NoError(t, idx.Close())
+}
@@ -0,0 +1,160 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+)
+
+// Topic names are used as directory names, so we keep them to a safe set of characters.
+var topicName = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+/**
+ * Topics manages the named topics on a server. Every topic is split into partitions, each backed by its own Log.
+ * A topic is stored in a subdirectory of Dir, with a subdirectory per partition named after its number.
+ * Topics are created the first time they're used and reopened from disk on startup.
+ */
+type Topics struct {
+	mu sync.Mutex
+
+	Dir    string
+	Config Config
+
+	topics map[string][]*Log
+}
+
+func NewTopics(dir string, c Config) (*Topics, error) {
+	if c.Topic.Partitions == 0 {
+		c.Topic.Partitions = 1
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	t := &Topics{
+		Dir:    dir,
+		Config: c,
+		topics: make(map[string][]*Log),
+	}
+	// Reopen every topic that already exists on disk.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !validTopic(entry.Name()) {
+			continue
+		}
+		if _, err := t.Partitions(entry.Name()); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Partitions returns the number of partitions in the topic, creating the topic if it doesn't exist yet.
+func (t *Topics) Partitions(name string) (uint32, error) {
+	partitions, err := t.topic(name)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(len(partitions)), nil
+}
+
+// Partition returns the log for a partition of the topic, creating the topic if it doesn't exist yet.
+func (t *Topics) Partition(name string, partition uint32) (*Log, error) {
+	partitions, err := t.topic(name)
+	if err != nil {
+		return nil, err
+	}
+	if partition >= uint32(len(partitions)) {
+		return nil, api.ErrInvalidPartition{Topic: name, Partition: partition}
+	}
+	return partitions[partition], nil
+}
+
+func (t *Topics) topic(name string) ([]*Log, error) {
+	if !validTopic(name) {
+		return nil, api.ErrInvalidTopic{Topic: name}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if partitions, ok := t.topics[name]; ok {
+		return partitions, nil
+	}
+	dir := filepath.Join(t.Dir, name)
+	count, err := existingPartitions(dir)
+	if err != nil {
+		return nil, err
+	}
+	// A topic keeps the number of partitions it was created with.
+	if count == 0 {
+		count = t.Config.Topic.Partitions
+	}
+	partitions := make([]*Log, count)
+	for i := range partitions {
+		if partitions[i], err = NewLog(filepath.Join(dir, strconv.Itoa(i)), t.Config); err != nil {
+			return nil, err
+		}
+	}
+	t.topics[name] = partitions
+	return partitions, nil
+}
+
+// existingPartitions counts the partition directories of a topic on disk.
+func existingPartitions(dir string) (uint32, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var count uint32
+	for _, entry := range entries {
+		if _, err := strconv.ParseUint(entry.Name(), 10, 32); entry.IsDir() && err == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Names returns the names of every topic in alphabetical order.
+func (t *Topics) Names() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := make([]string, 0, len(t.topics))
+	for name := range t.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (t *Topics) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, partitions := range t.topics {
+		for _, l := range partitions {
+			if err := l.Close(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (t *Topics) Remove() error {
+	if err := t.Close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(t.Dir)
+}
+
+func validTopic(name string) bool {
+	return name != "." && name != ".." && topicName.MatchString(name)
+}
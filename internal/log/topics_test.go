@@ -0,0 +1,65 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopics(t *testing.T) {
+	dir, err := os.MkdirTemp(os.TempDir(), "topics_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Topic.Partitions = 2
+	topics, err := NewTopics(dir, c)
+	require.NoError(t, err)
+
+	// Each partition of each topic has its own log and offsets.
+	for _, name := range []string{"orders", "payments"} {
+		partitions, err := topics.Partitions(name)
+		require.NoError(t, err)
+		require.Equal(t, uint32(2), partitions)
+		for p := uint32(0); p < partitions; p++ {
+			l, err := topics.Partition(name, p)
+			require.NoError(t, err)
+			off, err := l.Append(&api.Record{Value: []byte(name)})
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), off)
+		}
+		require.DirExists(t, filepath.Join(dir, name, "1"))
+	}
+
+	_, err = topics.Partition("orders", 2)
+	require.Equal(t, api.ErrInvalidPartition{Topic: "orders", Partition: 2}, err)
+
+	for _, name := range []string{"", ".", "..", "../orders", "a/b"} {
+		_, err := topics.Partitions(name)
+		require.Equal(t, api.ErrInvalidTopic{Topic: name}, err)
+	}
+	require.NoError(t, topics.Close())
+
+	// Existing topics are reopened from disk and keep their number of partitions.
+	c.Topic.Partitions = 4
+	topics, err = NewTopics(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders", "payments"}, topics.Names())
+	partitions, err := topics.Partitions("payments")
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), partitions)
+	l, err := topics.Partition("payments", 1)
+	require.NoError(t, err)
+	record, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("payments"), record.Value)
+
+	// New topics use the new number of partitions.
+	partitions, err = topics.Partitions("refunds")
+	require.NoError(t, err)
+	require.Equal(t, uint32(4), partitions)
+	require.NoError(t, topics.Remove())
+}
@@ -0,0 +1,146 @@
+package log
+
+import (
+	"context"
+	"maps"
+	"sort"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+)
+
+// abortedRange is where an aborted transaction's records are, from its first record up to its abort marker.
+type abortedRange struct {
+	first  uint64
+	marker uint64
+}
+
+/**
+ * transactions tracks the transactions in the log, so read committed consumers can skip aborted records and stop at the last stable offset.
+ * A transaction is open from its first record until its commit or abort marker. Like the producers, it's rebuilt from the records when the log is opened.
+ */
+type transactions struct {
+	// open maps the open transactions to the offset of their first record.
+	open    map[uint64]uint64
+	aborted map[uint64]abortedRange
+}
+
+func newTransactions() *transactions {
+	return &transactions{
+		open:    make(map[uint64]uint64),
+		aborted: make(map[uint64]abortedRange),
+	}
+}
+
+// copy returns transactions that later appends don't change.
+func (t *transactions) copy() *transactions {
+	c := newTransactions()
+	maps.Copy(c.open, t.open)
+	maps.Copy(c.aborted, t.aborted)
+	return c
+}
+
+// check returns an error if the record is a marker for a transaction that isn't open.
+func (t *transactions) check(record *api.Record) error {
+	if record.Control == api.ControlType_CONTROL_NONE {
+		return nil
+	}
+	if _, ok := t.open[record.TransactionId]; !ok || record.TransactionId == 0 {
+		return api.ErrUnknownTransaction{ID: record.TransactionId}
+	}
+	return nil
+}
+
+// add records that the record was appended, opening its transaction or ending it if it's a marker.
+func (t *transactions) add(record *api.Record) {
+	if record.TransactionId == 0 {
+		return
+	}
+	first, ok := t.open[record.TransactionId]
+	switch record.Control {
+	case api.ControlType_CONTROL_NONE:
+		if !ok {
+			t.open[record.TransactionId] = record.Offset
+		}
+	case api.ControlType_CONTROL_COMMIT:
+		delete(t.open, record.TransactionId)
+	case api.ControlType_CONTROL_ABORT:
+		delete(t.open, record.TransactionId)
+		if ok {
+			t.aborted[record.TransactionId] = abortedRange{first: first, marker: record.Offset}
+		}
+	}
+}
+
+// stable returns the last stable offset: the first offset of the oldest open transaction, or next if there are none.
+func (t *transactions) stable(next uint64) uint64 {
+	for _, first := range t.open {
+		next = min(next, first)
+	}
+	return next
+}
+
+// committed reports whether the record is one read committed consumers see. The caller checks it's before the last stable offset.
+func (t *transactions) committed(record *api.Record) bool {
+	if record.Control != api.ControlType_CONTROL_NONE {
+		return false
+	}
+	r, ok := t.aborted[record.TransactionId]
+	return !ok || record.Offset < r.first || record.Offset > r.marker
+}
+
+// trim forgets the aborted transactions that ended before the lowest offset, as their records are gone.
+func (t *transactions) trim(lowest uint64) {
+	for id, r := range t.aborted {
+		if r.marker < lowest {
+			delete(t.aborted, id)
+		}
+	}
+}
+
+// LastStableOffset returns the offset read committed consumers can read up to, which is where the oldest open transaction starts.
+func (l *Log) LastStableOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.transactions.stable(l.activeSegment.nextOffset)
+}
+
+// OpenTransactions returns the IDs of the transactions that were started in the log but not committed or aborted yet.
+func (l *Log) OpenTransactions() []uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	ids := make([]uint64, 0, len(l.transactions.open))
+	for id := range l.transactions.open {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// ReadCommitted returns the first record at or after the offset that read committed consumers see, skipping markers and aborted records.
+// It returns an ErrOffsetOutOfRange for offsets at or past the last stable offset.
+func (l *Log) ReadCommitted(offset uint64) (*api.Record, error) {
+	for off := offset; ; {
+		record, err := l.Read(off)
+		if err != nil {
+			return nil, err
+		}
+		l.mu.RLock()
+		stable := l.transactions.stable(l.activeSegment.nextOffset)
+		committed := l.transactions.committed(record)
+		l.mu.RUnlock()
+		if record.Offset >= stable {
+			return nil, api.ErrOffsetOutOfRange{Offset: offset}
+		}
+		if committed {
+			return record, nil
+		}
+		off = record.Offset + 1
+	}
+}
+
+// WaitCommitted blocks until ReadCommitted has a record at or after the offset to return, or the context is done.
+func (l *Log) WaitCommitted(ctx context.Context, offset uint64) error {
+	return l.wait(ctx, offset, l.ReadCommitted)
+}
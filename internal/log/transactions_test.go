@@ -0,0 +1,146 @@
+package log
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactions(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, log *Log,
+	){
+		"committed records become visible":        testTransactionCommit,
+		"aborted records are skipped":             testTransactionAbort,
+		"open transactions hold up other records": testTransactionStable,
+		"markers need an open transaction":        testTransactionUnknownMarker,
+		"transactions are rebuilt from the log":   testTransactionsReopen,
+		"waiting for committed records":           testTransactionWait,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp(os.TempDir(), "transactions_test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxIndexBytes = entWidth * 3
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			fn(t, log)
+		})
+	}
+}
+
+func appendTransactional(t *testing.T, log *Log, id uint64, value string) uint64 {
+	t.Helper()
+	off, err := log.Append(&api.Record{Value: []byte(value), TransactionId: id})
+	require.NoError(t, err)
+	return off
+}
+
+func endTransaction(t *testing.T, log *Log, id uint64, control api.ControlType) {
+	t.Helper()
+	_, err := log.Append(&api.Record{TransactionId: id, Control: control})
+	require.NoError(t, err)
+}
+
+// readCommitted returns the values read committed consumers see from the start of the log.
+func readCommitted(t *testing.T, log *Log) []string {
+	t.Helper()
+	var values []string
+	for off := uint64(0); ; {
+		record, err := log.ReadCommitted(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			return values
+		}
+		require.NoError(t, err)
+		values = append(values, string(record.Value))
+		off = record.Offset + 1
+	}
+}
+
+func testTransactionCommit(t *testing.T, log *Log) {
+	first := appendTransactional(t, log, 1, "a")
+	appendTransactional(t, log, 1, "b")
+	require.Equal(t, first, log.LastStableOffset())
+	require.Empty(t, readCommitted(t, log))
+	require.Equal(t, []uint64{1}, log.OpenTransactions())
+
+	endTransaction(t, log, 1, api.ControlType_CONTROL_COMMIT)
+	require.Equal(t, []string{"a", "b"}, readCommitted(t, log))
+	require.Equal(t, uint64(3), log.LastStableOffset())
+	require.Empty(t, log.OpenTransactions())
+}
+
+func testTransactionAbort(t *testing.T, log *Log) {
+	appendTransactional(t, log, 1, "aborted")
+	appendTransactional(t, log, 2, "committed")
+	appendTransactional(t, log, 1, "aborted")
+	endTransaction(t, log, 1, api.ControlType_CONTROL_ABORT)
+	endTransaction(t, log, 2, api.ControlType_CONTROL_COMMIT)
+	require.Equal(t, []string{"committed"}, readCommitted(t, log))
+
+	// Read uncommitted consumers see everything, including the markers.
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("aborted"), record.Value)
+	record, err = log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, api.ControlType_CONTROL_ABORT, record.Control)
+}
+
+func testTransactionStable(t *testing.T, log *Log) {
+	appendValues(t, log, "before")
+	appendTransactional(t, log, 1, "open")
+	appendValues(t, log, "after")
+	// Records after the open transaction wait for it, so read committed consumers see records in the order they were committed.
+	require.Equal(t, []string{"before"}, readCommitted(t, log))
+	endTransaction(t, log, 1, api.ControlType_CONTROL_COMMIT)
+	require.Equal(t, []string{"before", "open", "after"}, readCommitted(t, log))
+}
+
+func testTransactionUnknownMarker(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{TransactionId: 1, Control: api.ControlType_CONTROL_COMMIT})
+	require.Equal(t, api.ErrUnknownTransaction{ID: 1}, err)
+	appendTransactional(t, log, 1, "a")
+	endTransaction(t, log, 1, api.ControlType_CONTROL_COMMIT)
+	// The transaction already ended, so a retried marker isn't appended again.
+	_, err = log.Append(&api.Record{TransactionId: 1, Control: api.ControlType_CONTROL_COMMIT})
+	require.Equal(t, api.ErrUnknownTransaction{ID: 1}, err)
+}
+
+func testTransactionsReopen(t *testing.T, log *Log) {
+	appendTransactional(t, log, 1, "aborted")
+	appendTransactional(t, log, 2, "committed")
+	endTransaction(t, log, 1, api.ControlType_CONTROL_ABORT)
+	appendTransactional(t, log, 3, "open")
+	endTransaction(t, log, 2, api.ControlType_CONTROL_COMMIT)
+	require.NoError(t, log.Close())
+
+	n, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	require.Equal(t, []uint64{3}, n.OpenTransactions())
+	require.Equal(t, uint64(3), n.LastStableOffset())
+	require.Equal(t, []string{"committed"}, readCommitted(t, n))
+}
+
+func testTransactionWait(t *testing.T, log *Log) {
+	off := appendTransactional(t, log, 1, "a")
+	waited := make(chan error)
+	go func() {
+		waited <- log.WaitCommitted(context.Background(), off)
+	}()
+	// The record is in the log, but read committed consumers can't have it yet.
+	select {
+	case err := <-waited:
+		t.Fatalf("wait returned before the transaction was committed: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	endTransaction(t, log, 1, api.ControlType_CONTROL_COMMIT)
+	require.NoError(t, <-waited)
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+)
+
+// Partitioner picks the partition a record is produced to when the request doesn't name one.
+type Partitioner interface {
+	Partition(record *api.Record, partitions uint32) uint32
+}
+
+var _ Partitioner = (*HashPartitioner)(nil)
+
+/**
+ * HashPartitioner sends every record with the same key to the same partition by hashing the key.
+ * Records without a key are spread across the partitions round-robin.
+ */
+type HashPartitioner struct {
+	RoundRobinPartitioner
+}
+
+func (p *HashPartitioner) Partition(record *api.Record, partitions uint32) uint32 {
+	if len(record.Key) == 0 {
+		return p.RoundRobinPartitioner.Partition(record, partitions)
+	}
+	h := fnv.New32a()
+	_, _ = h.Write(record.Key)
+	return h.Sum32() % partitions
+}
+
+var _ Partitioner = (*RoundRobinPartitioner)(nil)
+
+// RoundRobinPartitioner spreads records evenly across the partitions, ignoring their keys.
+type RoundRobinPartitioner struct {
+	next atomic.Uint32
+}
+
+func (p *RoundRobinPartitioner) Partition(_ *api.Record, partitions uint32) uint32 {
+	return (p.next.Add(1) - 1) % partitions
+}
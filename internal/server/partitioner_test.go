@@ -0,0 +1,28 @@
+package server
+
+import (
+	"testing"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashPartitioner(t *testing.T) {
+	p := &HashPartitioner{}
+	record := &api.Record{Key: []byte("user-1")}
+	want := p.Partition(record, 8)
+	for i := 0; i < 10; i++ {
+		require.Equal(t, want, p.Partition(record, 8))
+	}
+	// Records without a key fall back to round-robin.
+	for i := uint32(0); i < 6; i++ {
+		require.Equal(t, i%3, p.Partition(&api.Record{}, 3))
+	}
+}
+
+func TestRoundRobinPartitioner(t *testing.T) {
+	p := &RoundRobinPartitioner{}
+	for i := uint32(0); i < 6; i++ {
+		require.Equal(t, i%3, p.Partition(&api.Record{Key: []byte("user-1")}, 3))
+	}
+}
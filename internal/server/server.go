@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"sort"
 	"time"
 
 	api "github.com/MartinMinkov/proglog/api/v1"
@@ -19,11 +20,26 @@ import (
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 type Config struct {
-	CommitLog  CommitLog
-	Authorizer Authorizer
+	// CommitLog stores the records of the default topic, used when a request doesn't name one.
+	CommitLog CommitLog
+	// TopicPartitions returns the number of partitions in a named topic, creating it if it doesn't exist yet.
+	TopicPartitions func(topic string) (uint32, error)
+	// TopicLog returns the commit log for a partition of a named topic.
+	TopicLog func(topic string, partition uint32) (CommitLog, error)
+	// Partitioner picks the partition for records produced without one, it defaults to a HashPartitioner.
+	Partitioner Partitioner
+	// Offsets stores the offsets committed by consumer groups.
+	Offsets OffsetStore
+	// Groups assigns partitions to the members of consumer groups.
+	Groups GroupCoordinator
+	// Transactions tracks transactions and ends them, transactions are unavailable without it.
+	Transactions TransactionCoordinator
+	Authorizer   Authorizer
+	GetServerer  GetServerer
 }
 
 const (
@@ -34,7 +50,55 @@ const (
 
 type CommitLog interface {
 	Append(record *api.Record) (uint64, error)
+	// AppendAt appends the record only if it gets the expected offset, otherwise it fails with an ErrOffsetMismatch.
+	AppendAt(record *api.Record, expected uint64) (uint64, error)
+	// AppendBatch appends the records with consecutive offsets and returns the offset of the first one.
+	AppendBatch(records []*api.Record) (uint64, error)
 	Read(offset uint64) (*api.Record, error)
+	// OffsetForTime returns the offset of the first record appended at or after the time, or the next offset if there is none.
+	OffsetForTime(t time.Time) (uint64, error)
+	// Wait blocks until there is a record at or after the offset to read, or the context is done.
+	Wait(ctx context.Context, offset uint64) error
+	// ReadCommitted is Read for read committed consumers, it skips transaction markers and aborted records and stops at the last stable offset.
+	ReadCommitted(offset uint64) (*api.Record, error)
+	// WaitCommitted is Wait for ReadCommitted.
+	WaitCommitted(ctx context.Context, offset uint64) error
+	LowestOffset() (uint64, error)
+	// HighestOffset returns the offset of the last record, or 0 if the log is empty.
+	HighestOffset() (uint64, error)
+	// LastStableOffset returns where the oldest open transaction starts, or the next offset if there are none.
+	LastStableOffset() uint64
+}
+
+// OffsetStore durably stores the offset each consumer group has reached in a topic partition.
+type OffsetStore interface {
+	Commit(group, topic string, partition uint32, offset uint64) error
+	Fetch(group, topic string, partition uint32) (offset uint64, committed bool, err error)
+}
+
+// GroupCoordinator tracks the members of consumer groups and assigns them partitions.
+type GroupCoordinator interface {
+	Join(group, memberID string, topics []string, strategy string) (string, uint64, error)
+	Sync(group, memberID string) (uint64, map[string][]uint32, error)
+	Heartbeat(group, memberID string, generation uint64) (uint64, bool, error)
+	Leave(group, memberID string) error
+	// Topics returns the topics the group's members subscribe to.
+	Topics(group string) []string
+	CheckGeneration(group, memberID string, generation uint64) error
+}
+
+// TransactionCoordinator tracks open transactions and ends them by writing markers to the partitions they produced to.
+type TransactionCoordinator interface {
+	Begin(owner string) (uint64, error)
+	// Produce runs write to append a record in the transaction to the partition.
+	Produce(id uint64, owner, topic string, partition uint32, write func() error) error
+	Commit(id uint64, owner string) error
+	Abort(id uint64, owner string) error
+}
+
+// GetServerer returns the servers in the cluster, so clients can discover them.
+type GetServerer interface {
+	GetServers() ([]*api.Server, error)
 }
 
 type Authorizer interface {
@@ -86,6 +150,9 @@ func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, err
 }
 
 func newgrpcServer(config *Config) (*grpcServer, error) {
+	if config.Partitioner == nil {
+		config.Partitioner = &HashPartitioner{}
+	}
 	server := &grpcServer{
 		Config: config,
 	}
@@ -93,23 +160,74 @@ func newgrpcServer(config *Config) (*grpcServer, error) {
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, produceAction); err != nil {
+	if err := s.authorize(ctx, req.Topic, produceAction); err != nil {
+		return nil, err
+	}
+	partition, err := s.partition(req)
+	if err != nil {
+		return nil, err
+	}
+	clog, err := s.commitLog(req.Topic, partition)
+	if err != nil {
 		return nil, err
 	}
-	offset, err := s.CommitLog.Append(req.Record)
+	// The log recognises retries from idempotent producers by the producer ID and sequence kept on the record.
+	req.Record.ProducerId = req.ProducerId
+	req.Record.Sequence = req.Sequence
+	// Only the transaction coordinator writes markers.
+	req.Record.TransactionId = req.TransactionId
+	req.Record.Control = api.ControlType_CONTROL_NONE
+	// The log stamps records with the time they're appended, not a time the producer picked.
+	req.Record.Timestamp = 0
+	var offset uint64
+	write := func() (err error) {
+		// Conditional appends let writers like event sourced aggregates make sure nobody appended since they last read.
+		if req.ExpectedOffset != nil {
+			offset, err = clog.AppendAt(req.Record, *req.ExpectedOffset)
+		} else {
+			offset, err = clog.Append(req.Record)
+		}
+		return err
+	}
+	if req.TransactionId != 0 {
+		if s.Transactions == nil {
+			return nil, status.Error(codes.Unimplemented, "transactions are not supported")
+		}
+		err = s.Transactions.Produce(req.TransactionId, subject(ctx), req.Topic, partition, write)
+	} else {
+		err = write()
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &api.ProduceResponse{
-		Offset: offset,
+		Offset:    offset,
+		Partition: partition,
 	}, nil
 }
 
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, produceAction); err != nil {
+	if err := s.authorize(ctx, req.Topic, consumeAction); err != nil {
+		return nil, err
+	}
+	clog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
 		return nil, err
 	}
-	record, err := s.CommitLog.Read(req.Offset)
+	offset, err := startOffset(clog, req)
+	if err != nil {
+		return nil, err
+	}
+	read, wait := reader(clog, req.ReadCommitted)
+	record, err := read(offset)
+	// Long polling consumers wait for the record to be appended, rather than asking for it over and over.
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok && req.MaxWaitMs > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx, time.Duration(req.MaxWaitMs)*time.Millisecond)
+		defer cancel()
+		if wait(waitCtx, offset) == nil {
+			record, err = read(offset)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -118,6 +236,233 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api
 	}, nil
 }
 
+// startOffset resolves the offset the request starts consuming from, which is relative to the ends of the log unless it asks for an offset.
+func startOffset(clog CommitLog, req *api.ConsumeRequest) (uint64, error) {
+	switch req.Start {
+	case api.StartPosition_START_OFFSET:
+		return req.Offset, nil
+	case api.StartPosition_START_EARLIEST:
+		return clog.LowestOffset()
+	case api.StartPosition_START_LATEST, api.StartPosition_START_RELATIVE:
+	default:
+		return 0, status.Errorf(codes.InvalidArgument, "unknown start position %s", req.Start)
+	}
+	lowest, err := clog.LowestOffset()
+	if err != nil {
+		return 0, err
+	}
+	end, err := endOffset(clog, lowest, req.ReadCommitted)
+	if err != nil {
+		return 0, err
+	}
+	if req.Start == api.StartPosition_START_LATEST {
+		return end, nil
+	}
+	// Compacted logs have gaps, so going back some offsets can mean going back fewer records.
+	if end-lowest < req.Offset {
+		return lowest, nil
+	}
+	return end - req.Offset, nil
+}
+
+// endOffset returns the offset after the last record, where a consumer starting at the end waits for the next record.
+// Read committed consumers end at the last stable offset, so they don't miss the records of transactions that are still open.
+func endOffset(clog CommitLog, lowest uint64, readCommitted bool) (uint64, error) {
+	if readCommitted {
+		return clog.LastStableOffset(), nil
+	}
+	highest, err := clog.HighestOffset()
+	if err != nil {
+		return 0, err
+	}
+	// The highest offset is 0 both when the log is empty and when it only has a record at 0, so we check which it is.
+	if highest == 0 && lowest == 0 {
+		if _, err := clog.Read(0); err != nil {
+			if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+				return 0, nil
+			}
+			return 0, err
+		}
+	}
+	return highest + 1, nil
+}
+
+// reader returns how to read and wait for records, depending on whether the consumer only reads committed records.
+func reader(clog CommitLog, readCommitted bool) (func(uint64) (*api.Record, error), func(context.Context, uint64) error) {
+	if readCommitted {
+		return clog.ReadCommitted, clog.WaitCommitted
+	}
+	return clog.Read, clog.Wait
+}
+
+// ProduceBatch appends many records to a single partition in one go, which is much cheaper than producing them one at a time.
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	if err := s.authorize(ctx, req.Topic, produceAction); err != nil {
+		return nil, err
+	}
+	// Producers can send the records compressed, in which case we decompress them so they can be partitioned and given offsets.
+	if req.Batch != nil {
+		records, err := req.Batch.Decode()
+		if err != nil {
+			return nil, err
+		}
+		req.Records = append(req.Records, records...)
+	}
+	if len(req.Records) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "batch has no records")
+	}
+	// Only single produces are idempotent or transactional, so we don't let batched records pass for an idempotent producer's or a transaction's.
+	for _, record := range req.Records {
+		record.ProducerId, record.Sequence = 0, 0
+		record.TransactionId, record.Control = 0, api.ControlType_CONTROL_NONE
+		record.Timestamp = 0
+	}
+	partition, err := s.batchPartition(req)
+	if err != nil {
+		return nil, err
+	}
+	clog, err := s.commitLog(req.Topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := clog.AppendBatch(req.Records)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ProduceBatchResponse{
+		BaseOffset: offset,
+		LastOffset: offset + uint64(len(req.Records)) - 1,
+		Partition:  partition,
+	}, nil
+}
+
+// batchPartition picks the partition for the whole batch from its first keyed record, and checks every other keyed record belongs to it too.
+func (s *grpcServer) batchPartition(req *api.ProduceBatchRequest) (uint32, error) {
+	var keyed []*api.Record
+	for _, record := range req.Records {
+		if len(record.Key) > 0 {
+			keyed = append(keyed, record)
+		}
+	}
+	first := req.Records[0]
+	if len(keyed) > 0 {
+		first = keyed[0]
+	}
+	partition, err := s.partition(&api.ProduceRequest{Record: first, Topic: req.Topic, Partition: req.Partition})
+	if err != nil || req.Partition != nil || req.Topic == "" {
+		return partition, err
+	}
+	partitions, err := s.TopicPartitions(req.Topic)
+	if err != nil {
+		return 0, err
+	}
+	for _, record := range keyed {
+		if s.Partitioner.Partition(record, partitions) != partition {
+			return 0, status.Error(codes.InvalidArgument, "keyed records in a batch must belong to the same partition")
+		}
+	}
+	return partition, nil
+}
+
+const (
+	defaultBatchRecords = 500
+	defaultBatchBytes   = 1 << 20
+)
+
+// ConsumeBatch returns the records from the offset onwards, up to the request's record and byte limits.
+func (s *grpcServer) ConsumeBatch(ctx context.Context, req *api.ConsumeBatchRequest) (*api.ConsumeBatchResponse, error) {
+	if err := s.authorize(ctx, req.Topic, consumeAction); err != nil {
+		return nil, err
+	}
+	clog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	maxRecords, maxBytes := int(req.MaxRecords), req.MaxBytes
+	if maxRecords == 0 {
+		maxRecords = defaultBatchRecords
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultBatchBytes
+	}
+	read, _ := reader(clog, req.ReadCommitted)
+	res := &api.ConsumeBatchResponse{NextOffset: req.Offset}
+	var size uint64
+	for len(res.Records) < maxRecords {
+		record, err := read(res.NextOffset)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok && len(res.Records) > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The first record is always returned, otherwise a record bigger than the limit would never be consumed.
+		size += uint64(proto.Size(record))
+		if size > maxBytes && len(res.Records) > 0 {
+			break
+		}
+		res.Records = append(res.Records, record)
+		res.NextOffset = record.Offset + 1
+	}
+	if req.Codec != api.Codec_CODEC_NONE {
+		if res.Batch, err = api.NewRecordBatch(req.Codec, res.Records); err != nil {
+			return nil, err
+		}
+		res.Records = nil
+	}
+	return res, nil
+}
+
+// OffsetForTime finds where to start consuming to replay everything appended since a point in time.
+func (s *grpcServer) OffsetForTime(ctx context.Context, req *api.OffsetForTimeRequest) (*api.OffsetForTimeResponse, error) {
+	if err := s.authorize(ctx, req.Topic, consumeAction); err != nil {
+		return nil, err
+	}
+	clog, err := s.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := clog.OffsetForTime(time.Unix(0, req.Timestamp))
+	if err != nil {
+		return nil, err
+	}
+	return &api.OffsetForTimeResponse{Offset: offset}, nil
+}
+
+// BeginTransaction starts a transaction, which only the subject that began it can produce in and end.
+func (s *grpcServer) BeginTransaction(ctx context.Context, req *api.BeginTransactionRequest) (*api.BeginTransactionResponse, error) {
+	if s.Transactions == nil {
+		return nil, status.Error(codes.Unimplemented, "transactions are not supported")
+	}
+	id, err := s.Transactions.Begin(subject(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return &api.BeginTransactionResponse{TransactionId: id}, nil
+}
+
+// CommitTransaction makes the transaction's records visible to read committed consumers, in every partition it produced to.
+func (s *grpcServer) CommitTransaction(ctx context.Context, req *api.EndTransactionRequest) (*api.EndTransactionResponse, error) {
+	if s.Transactions == nil {
+		return nil, status.Error(codes.Unimplemented, "transactions are not supported")
+	}
+	if err := s.Transactions.Commit(req.TransactionId, subject(ctx)); err != nil {
+		return nil, err
+	}
+	return &api.EndTransactionResponse{}, nil
+}
+
+// AbortTransaction discards the transaction's records for read committed consumers.
+func (s *grpcServer) AbortTransaction(ctx context.Context, req *api.EndTransactionRequest) (*api.EndTransactionResponse, error) {
+	if s.Transactions == nil {
+		return nil, status.Error(codes.Unimplemented, "transactions are not supported")
+	}
+	if err := s.Transactions.Abort(req.TransactionId, subject(ctx)); err != nil {
+		return nil, err
+	}
+	return &api.EndTransactionResponse{}, nil
+}
+
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	for {
 		request, err := stream.Recv()
@@ -134,26 +479,241 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	}
 }
 
+// ConsumeStream streams the records from the requested offset onwards. Once it catches up it blocks until more records are appended, until the client goes away.
 func (s *grpcServer) ConsumeStream(request *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	ctx := stream.Context()
+	if err := s.authorize(ctx, request.Topic, consumeAction); err != nil {
+		return err
+	}
+	// We resolve where to start once, then follow the log from there by offset.
+	clog, err := s.commitLog(request.Topic, request.Partition)
+	if err != nil {
+		return err
+	}
+	if request.Offset, err = startOffset(clog, request); err != nil {
+		return err
+	}
+	request.Start = api.StartPosition_START_OFFSET
 	for {
-		select {
-		case <-stream.Context().Done():
-			return nil
-		default:
-			response, err := s.Consume(stream.Context(), request)
-			switch err.(type) {
-			case nil:
-			case api.ErrOffsetOutOfRange:
-				continue
-			default:
-				return err
-			}
-			if err = stream.Send(response); err != nil {
+		response, err := s.Consume(ctx, request)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetOutOfRange:
+			_, wait := reader(clog, request.ReadCommitted)
+			if err = wait(ctx, request.Offset); err != nil {
+				// The client is gone, so there's no one to tell.
+				if ctx.Err() != nil {
+					return nil
+				}
 				return err
 			}
-			request.Offset++
+			continue
+		default:
+			return err
+		}
+		if err = stream.Send(response); err != nil {
+			return err
 		}
+		// Compacted logs skip over removed offsets, so we continue after the record we were given.
+		request.Offset = response.Record.Offset + 1
+	}
+}
+
+// authorize checks the subject may perform the action on the topic.
+// The default topic is authorized against the wildcard object, named topics against their own name.
+func (s *grpcServer) authorize(ctx context.Context, topic, action string) error {
+	object := topic
+	if topic == "" {
+		object = objectWildCard
+	}
+	return s.Authorizer.Authorize(subject(ctx), object, action)
+}
+
+// partition returns the partition the request names, or asks the partitioner to pick one.
+func (s *grpcServer) partition(req *api.ProduceRequest) (uint32, error) {
+	if req.Partition != nil {
+		return *req.Partition, nil
+	}
+	// The default topic only has a single partition.
+	if req.Topic == "" {
+		return 0, nil
+	}
+	if s.TopicPartitions == nil {
+		return 0, status.Error(codes.Unimplemented, "topics are not supported by this server")
+	}
+	partitions, err := s.TopicPartitions(req.Topic)
+	if err != nil {
+		return 0, err
+	}
+	return s.Partitioner.Partition(req.Record, partitions), nil
+}
+
+// commitLog returns the commit log for a partition of the topic.
+func (s *grpcServer) commitLog(topic string, partition uint32) (CommitLog, error) {
+	if topic == "" {
+		if partition != 0 {
+			return nil, api.ErrInvalidPartition{Topic: topic, Partition: partition}
+		}
+		return s.CommitLog, nil
+	}
+	if s.TopicLog == nil {
+		return nil, status.Error(codes.Unimplemented, "topics are not supported by this server")
+	}
+	return s.TopicLog(topic, partition)
+}
+
+func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (*api.GetServersResponse, error) {
+	if s.GetServerer == nil {
+		return nil, status.Error(codes.Unimplemented, "server is not part of a cluster")
+	}
+	servers, err := s.GetServerer.GetServers()
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetServersResponse{Servers: servers}, nil
+}
+
+// CommitOffset records the offset a consumer group has reached, so its consumers can resume from it after a restart.
+func (s *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group, req.Topic); err != nil {
+		return nil, err
+	}
+	if _, err := s.commitLog(req.Topic, req.Partition); err != nil {
+		return nil, err
+	}
+	// A member of a coordinated group may only commit for its current generation, as after a rebalance its partitions may belong to another member.
+	if req.MemberId != "" {
+		if err := s.checkGroups(req.Group); err != nil {
+			return nil, err
+		}
+		if err := s.Groups.CheckGeneration(req.Group, req.MemberId, req.Generation); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Offsets.Commit(req.Group, req.Topic, req.Partition, req.Offset); err != nil {
+		return nil, err
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+// FetchOffset returns the last offset the consumer group committed for the topic partition.
+func (s *grpcServer) FetchOffset(ctx context.Context, req *api.FetchOffsetRequest) (*api.FetchOffsetResponse, error) {
+	if err := s.authorizeGroup(ctx, req.Group, req.Topic); err != nil {
+		return nil, err
+	}
+	offset, committed, err := s.Offsets.Fetch(req.Group, req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	return &api.FetchOffsetResponse{
+		Offset:    offset,
+		Committed: committed,
+	}, nil
+}
+
+// JoinGroup adds a consumer to a group, which rebalances the group's partitions between its members.
+func (s *grpcServer) JoinGroup(ctx context.Context, req *api.JoinGroupRequest) (*api.JoinGroupResponse, error) {
+	if err := s.checkGroups(req.Group); err != nil {
+		return nil, err
+	}
+	for _, topic := range req.Topics {
+		if err := s.authorize(ctx, topic, consumeAction); err != nil {
+			return nil, err
+		}
+	}
+	memberID, generation, err := s.Groups.Join(req.Group, req.MemberId, req.Topics, req.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	return &api.JoinGroupResponse{
+		MemberId:   memberID,
+		Generation: generation,
+	}, nil
+}
+
+// SyncGroup returns the partitions assigned to the member in the group's current generation.
+func (s *grpcServer) SyncGroup(ctx context.Context, req *api.SyncGroupRequest) (*api.SyncGroupResponse, error) {
+	if err := s.authorizeMember(ctx, req.Group); err != nil {
+		return nil, err
+	}
+	generation, assignment, err := s.Groups.Sync(req.Group, req.MemberId)
+	if err != nil {
+		return nil, err
+	}
+	topics := make([]string, 0, len(assignment))
+	for topic := range assignment {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	res := &api.SyncGroupResponse{Generation: generation}
+	for _, topic := range topics {
+		res.Assignment = append(res.Assignment, &api.TopicPartitions{
+			Topic:      topic,
+			Partitions: assignment[topic],
+		})
+	}
+	return res, nil
+}
+
+// Heartbeat keeps the member in its group and tells it when it needs to sync a new assignment.
+func (s *grpcServer) Heartbeat(ctx context.Context, req *api.HeartbeatRequest) (*api.HeartbeatResponse, error) {
+	if err := s.authorizeMember(ctx, req.Group); err != nil {
+		return nil, err
+	}
+	generation, rebalance, err := s.Groups.Heartbeat(req.Group, req.MemberId, req.Generation)
+	if err != nil {
+		return nil, err
+	}
+	return &api.HeartbeatResponse{
+		Generation: generation,
+		Rebalance:  rebalance,
+	}, nil
+}
+
+// LeaveGroup removes the member from its group, handing its partitions to the remaining members.
+func (s *grpcServer) LeaveGroup(ctx context.Context, req *api.LeaveGroupRequest) (*api.LeaveGroupResponse, error) {
+	if err := s.authorizeMember(ctx, req.Group); err != nil {
+		return nil, err
+	}
+	if err := s.Groups.Leave(req.Group, req.MemberId); err != nil {
+		return nil, err
+	}
+	return &api.LeaveGroupResponse{}, nil
+}
+
+// authorizeGroup checks a consumer group offset request is valid and the subject may consume from the topic.
+func (s *grpcServer) authorizeGroup(ctx context.Context, group, topic string) error {
+	if s.Offsets == nil {
+		return status.Error(codes.Unimplemented, "consumer group offsets are not supported by this server")
+	}
+	if group == "" {
+		return status.Error(codes.InvalidArgument, "consumer group is required")
+	}
+	return s.authorize(ctx, topic, consumeAction)
+}
+
+// authorizeMember checks the subject may consume from every topic the group subscribes to, as JoinGroup checked for its members.
+// Otherwise anyone could sync, heartbeat as or remove another member of a group they can't consume from.
+func (s *grpcServer) authorizeMember(ctx context.Context, group string) error {
+	if err := s.checkGroups(group); err != nil {
+		return err
+	}
+	for _, topic := range s.Groups.Topics(group) {
+		if err := s.authorize(ctx, topic, consumeAction); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *grpcServer) checkGroups(group string) error {
+	if s.Groups == nil {
+		return status.Error(codes.Unimplemented, "consumer groups are not supported by this server")
+	}
+	if group == "" {
+		return status.Error(codes.InvalidArgument, "consumer group is required")
 	}
+	return nil
 }
 
 func authenticate(ctx context.Context) (context.Context, error) {
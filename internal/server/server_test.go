@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"os"
 	"testing"
@@ -10,10 +11,13 @@ import (
 	api "github.com/MartinMinkov/proglog/api/v1"
 	"github.com/MartinMinkov/proglog/internal/auth"
 	"github.com/MartinMinkov/proglog/internal/config"
+	"github.com/MartinMinkov/proglog/internal/group"
 	"github.com/MartinMinkov/proglog/internal/log"
+	"github.com/MartinMinkov/proglog/internal/transaction"
 	"github.com/stretchr/testify/require"
 	"go.opencensus.io/examples/exporter"
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
@@ -34,10 +38,24 @@ func TestMain(m *testing.M) {
 
 func TestServer(t *testing.T) {
 	for scenario, fn := range map[string]func(t *testing.T, rootClient, nobodyClient api.LogClient, config *Config){
-		"produce/consume a message to/form the log succeeds": testProduceConsume,
-		"produce/consume stream succeeds":                    testProduceConsumeStream,
-		"consume past log boundry fails":                     testConsumePastBoundry,
-		"unauthorized access fails":                          testUnauthorized,
+		"produce/consume a message to/form the log succeeds":  testProduceConsume,
+		"produce/consume stream succeeds":                     testProduceConsumeStream,
+		"consume past log boundry fails":                      testConsumePastBoundry,
+		"unauthorized access fails":                           testUnauthorized,
+		"produce/consume to/from a topic succeeds":            testProduceConsumeTopic,
+		"topic access is authorized per topic":                testTopicAuthorization,
+		"produce/consume to/from partitions succeeds":         testProduceConsumePartitions,
+		"commit/fetch consumer group offsets succeeds":        testCommitFetchOffset,
+		"consumer group members are assigned partitions":      testConsumerGroup,
+		"offset for time finds records appended since":        testOffsetForTime,
+		"produce/consume batches succeeds":                    testProduceConsumeBatch,
+		"batches of keyed records stay in one partition":      testProduceBatchPartitions,
+		"produce/consume compressed batches succeeds":         testProduceConsumeCompressedBatch,
+		"consumers wait for records to be produced":           testLongPoll,
+		"retried produces aren't duplicated":                  testIdempotentProduce,
+		"transactions are read once committed":                testTransactions,
+		"conditional produces need the expected offset":       testConditionalProduce,
+		"consumers can start relative to the ends of the log": testStartPosition,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient, nobodyClient, config, teardown := setupTest(t, nil)
@@ -81,10 +99,48 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	clog, err := log.NewLog(dir, log.Config{})
 	require.NoError(t, err)
 
+	topicsDir, err := os.MkdirTemp(os.TempDir(), "server_test_topics")
+	require.NoError(t, err)
+	topicsConfig := log.Config{}
+	topicsConfig.Topic.Partitions = 3
+	topics, err := log.NewTopics(topicsDir, topicsConfig)
+	require.NoError(t, err)
+
+	offsetsDir, err := os.MkdirTemp(os.TempDir(), "server_test_offsets")
+	require.NoError(t, err)
+	offsets, err := log.NewOffsets(offsetsDir, log.Config{})
+	require.NoError(t, err)
+
+	groups := group.NewCoordinator(group.Config{
+		Partitions: topics.Partitions,
+	})
+
+	txns := transaction.NewCoordinator(transaction.Config{
+		WriteMarker: func(topic string, partition uint32, marker *api.Record) error {
+			if topic == "" {
+				_, err := clog.Append(marker)
+				return err
+			}
+			plog, err := topics.Partition(topic, partition)
+			if err != nil {
+				return err
+			}
+			_, err = plog.Append(marker)
+			return err
+		},
+	})
+
 	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
 	cfg := &Config{
-		CommitLog:  clog,
-		Authorizer: authorizer,
+		CommitLog:       clog,
+		TopicPartitions: topics.Partitions,
+		TopicLog: func(topic string, partition uint32) (CommitLog, error) {
+			return topics.Partition(topic, partition)
+		},
+		Offsets:      offsets,
+		Groups:       groups,
+		Transactions: txns,
+		Authorizer:   authorizer,
 	}
 
 	var telemetryExporter *exporter.LogExporter
@@ -145,6 +201,10 @@ func setupTest(t *testing.T, fn func(*Config)) (
 		rootConn.Close()
 		nobodyConn.Close()
 		l.Close()
+		topics.Remove()
+		offsets.Remove()
+		groups.Close()
+		txns.Close()
 		clog.Remove()
 		if telemetryExporter != nil {
 			time.Sleep(1500 * time.Millisecond)
@@ -157,7 +217,9 @@ func setupTest(t *testing.T, fn func(*Config)) (
 func testProduceConsume(t *testing.T, client, _ api.LogClient, config *Config) {
 	ctx := context.Background()
 	want := &api.Record{
-		Value: []byte("hello world"),
+		Value:   []byte("hello world"),
+		Key:     []byte("key"),
+		Headers: []*api.Header{{Key: "content-type", Value: []byte("text/plain")}},
 	}
 
 	// Create a produce request and send it to the server with the record value
@@ -170,6 +232,139 @@ func testProduceConsume(t *testing.T, client, _ api.LogClient, config *Config) {
 	// Assert that the consumed record matches the produce record
 	require.Equal(t, want.Value, consume.Record.Value)
 	require.Equal(t, produce.Offset, consume.Record.Offset)
+	// The key and headers are kept alongside the value.
+	require.Equal(t, want.Key, consume.Record.Key)
+	require.Equal(t, 1, len(consume.Record.Headers))
+	require.Equal(t, "content-type", consume.Record.Headers[0].Key)
+	require.Equal(t, []byte("text/plain"), consume.Record.Headers[0].Value)
+}
+
+func testProduceConsumeBatch(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	records := []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+		{Value: []byte("third")},
+	}
+
+	produce, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.BaseOffset)
+	require.Equal(t, uint64(2), produce.LastOffset)
+
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// The batch stops at the record limit.
+	consume, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: 0, MaxRecords: 2})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(consume.Records))
+	require.Equal(t, []byte("first"), consume.Records[0].Value)
+	require.Equal(t, []byte("second"), consume.Records[1].Value)
+	require.Equal(t, uint64(2), consume.NextOffset)
+
+	// The batch stops at the end of the log.
+	consume, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: consume.NextOffset})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(consume.Records))
+	require.Equal(t, []byte("third"), consume.Records[0].Value)
+	require.Equal(t, uint64(3), consume.NextOffset)
+
+	// The first record is returned even if it is over the byte limit.
+	consume, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: 0, MaxBytes: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(consume.Records))
+
+	_, err = client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Offset: 3})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+}
+
+func testProduceConsumeCompressedBatch(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	records := []*api.Record{
+		{Value: []byte(`{"hello": "world"}`)},
+		{Value: []byte(`{"hello": "again"}`)},
+	}
+	batch, err := api.NewRecordBatch(api.Codec_CODEC_ZSTD, records)
+	require.NoError(t, err)
+
+	produce, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Batch: batch})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), produce.LastOffset)
+
+	consume, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Codec: api.Codec_CODEC_GZIP})
+	require.NoError(t, err)
+	require.Empty(t, consume.Records)
+	got, err := consume.Batch.Decode()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(got))
+	require.Equal(t, records[1].Value, got[1].Value)
+
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Batch: &api.RecordBatch{Codec: api.Codec_CODEC_GZIP, Records: []byte("not gzip")},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// A batch that's small on the wire but decompresses past the limit is rejected rather than decompressed.
+	bomb := []*api.Record{{Value: make([]byte, api.MaxBatchBytes)}}
+	for _, codec := range []api.Codec{api.Codec_CODEC_GZIP, api.Codec_CODEC_SNAPPY, api.Codec_CODEC_ZSTD} {
+		batch, err := api.NewRecordBatch(codec, bomb)
+		require.NoError(t, err)
+		_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{Batch: batch})
+		require.Equal(t, codes.InvalidArgument, status.Code(err), codec.String())
+	}
+}
+
+func testProduceBatchPartitions(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	keyed := &api.Record{Key: []byte("user-1"), Value: []byte("keyed")}
+	want := config.Partitioner.Partition(keyed, 3)
+
+	produce, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Topic:   "events",
+		Records: []*api.Record{{Value: []byte("no key")}, keyed},
+	})
+	require.NoError(t, err)
+	require.Equal(t, want, produce.Partition)
+
+	consume, err := client.ConsumeBatch(ctx, &api.ConsumeBatchRequest{Topic: "events", Partition: want})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(consume.Records))
+
+	// Find a key that belongs to another partition.
+	other := keyed
+	for i := 0; config.Partitioner.Partition(other, 3) == want; i++ {
+		other = &api.Record{Key: []byte{byte(i)}, Value: []byte("other")}
+	}
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Topic:   "events",
+		Records: []*api.Record{keyed, other},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testOffsetForTime(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("before")}})
+	require.NoError(t, err)
+	since := time.Now()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("after")}})
+	require.NoError(t, err)
+
+	res, err := client.OffsetForTime(ctx, &api.OffsetForTimeRequest{Timestamp: since.UnixNano()})
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset, res.Offset)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: res.Offset})
+	require.NoError(t, err)
+	require.Equal(t, []byte("after"), consume.Record.Value)
+	require.GreaterOrEqual(t, consume.Record.Timestamp, since.UnixNano())
+
+	// Nothing was appended after now, so consumers start at the end of the log.
+	res, err = client.OffsetForTime(ctx, &api.OffsetForTimeRequest{Timestamp: time.Now().UnixNano()})
+	require.NoError(t, err)
+	require.Equal(t, produce.Offset+1, res.Offset)
 }
 
 func testConsumePastBoundry(t *testing.T, client, _ api.LogClient, config *Config) {
@@ -214,15 +409,184 @@ func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, config *Con
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
+			// Records are stamped with the time they were appended.
+			require.NotZero(t, res.Record.Timestamp)
 			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
+				Value:     record.Value,
+				Offset:    uint64(i),
+				Timestamp: res.Record.Timestamp,
 			})
 		}
 	}
 
 }
 
+func testLongPoll(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	// Nothing is produced, so consumers give up once they've waited long enough.
+	start := time.Now()
+	_, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0, MaxWaitMs: 50})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	consumed := make(chan *api.ConsumeResponse)
+	go func() {
+		// A failed consume sends nil, which fails the check below.
+		consume, _ := client.Consume(ctx, &api.ConsumeRequest{Offset: 0, MaxWaitMs: 5000})
+		consumed <- consume
+	}()
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+
+	for i, value := range []string{"first", "second"} {
+		// Give the consumers a chance to start waiting before we produce.
+		time.Sleep(20 * time.Millisecond)
+		_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+		require.NoError(t, err)
+		if i == 0 {
+			consume := <-consumed
+			require.NotNil(t, consume)
+			require.Equal(t, []byte(value), consume.Record.Value)
+		}
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte(value), res.Record.Value)
+	}
+}
+
+func testIdempotentProduce(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	// The producer retries the first record, as if it never saw the response.
+	var offsets []uint64
+	for _, seq := range []uint64{0, 0, 1} {
+		err = stream.Send(&api.ProduceRequest{
+			Record:     &api.Record{Value: []byte(fmt.Sprintf("record %d", seq))},
+			ProducerId: 1,
+			Sequence:   seq,
+		})
+		require.NoError(t, err)
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		offsets = append(offsets, res.Offset)
+	}
+	require.Equal(t, []uint64{0, 0, 1}, offsets)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 1"), consume.Record.Value)
+	require.Equal(t, uint64(1), consume.Record.ProducerId)
+
+	// A sequence the producer skipped over can't be matched up with a record.
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{}, ProducerId: 2, Sequence: 5})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{}, ProducerId: 2, Sequence: 3})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func testTransactions(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	for _, end := range []string{"commit", "abort"} {
+		begin, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+		require.NoError(t, err)
+		id := begin.TransactionId
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Record:        &api.Record{Value: []byte(end)},
+			TransactionId: id,
+		})
+		require.NoError(t, err)
+
+		// Read uncommitted consumers see the record straight away, read committed ones wait for the commit.
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+		require.NoError(t, err)
+		require.Equal(t, []byte(end), consume.Record.Value)
+		_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset, ReadCommitted: true})
+		require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+		if end == "commit" {
+			_, err = client.CommitTransaction(ctx, &api.EndTransactionRequest{TransactionId: id})
+		} else {
+			_, err = client.AbortTransaction(ctx, &api.EndTransactionRequest{TransactionId: id})
+		}
+		require.NoError(t, err)
+		// The transaction is over, so it can't be produced to again.
+		_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{}, TransactionId: id})
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	}
+
+	// Only the committed record is read, the aborted one and the markers are skipped.
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0, ReadCommitted: true})
+	require.NoError(t, err)
+	require.Equal(t, []byte("commit"), consume.Record.Value)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: consume.Record.Offset + 1, ReadCommitted: true})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+}
+
+func testConditionalProduce(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	expected := uint64(0)
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record:         &api.Record{Value: []byte("created")},
+		ExpectedOffset: &expected,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	// Someone else wrote the next offset first, so the status tells us where the log is now.
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:         &api.Record{Value: []byte("updated")},
+		ExpectedOffset: &expected,
+	})
+	st := status.Convert(err)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+	require.Len(t, st.Details(), 1)
+	info := st.Details()[0].(*errdetails.ErrorInfo)
+	require.Equal(t, "1", info.Metadata["next_offset"])
+}
+
+func testStartPosition(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	produce := func(values ...string) {
+		t.Helper()
+		for _, value := range values {
+			_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+			require.NoError(t, err)
+		}
+	}
+	// Tailing an empty log from the end gets every record produced after it started.
+	empty, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Start: api.StartPosition_START_LATEST})
+	require.NoError(t, err)
+	// Give the stream a chance to find the end before we produce.
+	time.Sleep(20 * time.Millisecond)
+	produce("0", "1", "2", "3", "4")
+	res, err := empty.Recv()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Record.Offset)
+
+	for start, want := range map[*api.ConsumeRequest]uint64{
+		{Start: api.StartPosition_START_EARLIEST}:              0,
+		{Start: api.StartPosition_START_RELATIVE, Offset: 2}:   3,
+		{Start: api.StartPosition_START_RELATIVE, Offset: 100}: 0,
+	} {
+		consume, err := client.Consume(ctx, start)
+		require.NoError(t, err)
+		require.Equal(t, want, consume.Record.Offset)
+	}
+	// There's nothing after the end yet.
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Start: api.StartPosition_START_LATEST})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	latest, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Start: api.StartPosition_START_LATEST})
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	produce("5")
+	res, err = latest.Recv()
+	require.NoError(t, err)
+	require.Equal(t, []byte("5"), res.Record.Value)
+}
+
 func testUnauthorized(t *testing.T, _, client api.LogClient, config *Config) {
 	ctx := context.Background()
 	produce, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}})
@@ -242,3 +606,181 @@ func testUnauthorized(t *testing.T, _, client api.LogClient, config *Config) {
 		t.Fatalf("got err code: %d, want err code: %d", gotCode, wantCode)
 	}
 }
+
+func testProduceConsumeTopic(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+	for _, topic := range []string{"orders", "payments"} {
+		want := &api.Record{
+			Value: []byte(topic),
+		}
+		produce, err := client.Produce(ctx, &api.ProduceRequest{Record: want, Topic: topic})
+		require.NoError(t, err)
+		// Every topic has its own offsets.
+		require.Equal(t, uint64(0), produce.Offset)
+
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset, Topic: topic, Partition: produce.Partition})
+		require.NoError(t, err)
+		require.Equal(t, want.Value, consume.Record.Value)
+	}
+
+	// The default topic is separate from the named topics.
+	_, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err()), status.Code(err))
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}, Topic: "../orders"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testTopicAuthorization(t *testing.T, rootClient, nobodyClient api.LogClient, config *Config) {
+	ctx := context.Background()
+	produce, err := rootClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}, Topic: "public"})
+	require.NoError(t, err)
+
+	// nobody is only allowed to consume from the public topic.
+	consume, err := nobodyClient.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset, Topic: "public", Partition: produce.Partition})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), consume.Record.Value)
+
+	_, err = nobodyClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}, Topic: "public"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = nobodyClient.Consume(ctx, &api.ConsumeRequest{Offset: 0, Topic: "private"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testProduceConsumePartitions(t *testing.T, client, _ api.LogClient, config *Config) {
+	ctx := context.Background()
+
+	// Records with the same key always go to the same partition.
+	var partition uint32
+	for i := 0; i < 3; i++ {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world"), Key: []byte("user-1")},
+			Topic:  "orders",
+		})
+		require.NoError(t, err)
+		if i == 0 {
+			partition = produce.Partition
+		}
+		require.Equal(t, partition, produce.Partition)
+		require.Equal(t, uint64(i), produce.Offset)
+	}
+
+	// Records without a key are spread across every partition.
+	seen := map[uint32]bool{}
+	for i := 0; i < 3; i++ {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+			Topic:  "payments",
+		})
+		require.NoError(t, err)
+		seen[produce.Partition] = true
+	}
+	require.Len(t, seen, 3)
+
+	// Records can be produced to an explicit partition, and are consumed by (topic, partition, offset).
+	explicit := uint32(2)
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record:    &api.Record{Value: []byte("explicit"), Key: []byte("user-1")},
+		Topic:     "refunds",
+		Partition: &explicit,
+	})
+	require.NoError(t, err)
+	require.Equal(t, explicit, produce.Partition)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "refunds", Partition: explicit, Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, []byte("explicit"), consume.Record.Value)
+	require.Equal(t, []byte("user-1"), consume.Record.Key)
+
+	invalid := uint32(3)
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:    &api.Record{Value: []byte("hello world")},
+		Topic:     "refunds",
+		Partition: &invalid,
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Partition: 1})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testCommitFetchOffset(t *testing.T, rootClient, nobodyClient api.LogClient, config *Config) {
+	ctx := context.Background()
+	fetch, err := rootClient.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "billing", Topic: "orders", Partition: 1})
+	require.NoError(t, err)
+	require.False(t, fetch.Committed)
+
+	_, err = rootClient.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing", Topic: "orders", Partition: 1, Offset: 42})
+	require.NoError(t, err)
+
+	fetch, err = rootClient.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "billing", Topic: "orders", Partition: 1})
+	require.NoError(t, err)
+	require.True(t, fetch.Committed)
+	require.Equal(t, uint64(42), fetch.Offset)
+
+	// Offsets are tracked separately for every partition.
+	fetch, err = rootClient.FetchOffset(ctx, &api.FetchOffsetRequest{Group: "billing", Topic: "orders", Partition: 0})
+	require.NoError(t, err)
+	require.False(t, fetch.Committed)
+
+	_, err = rootClient.CommitOffset(ctx, &api.CommitOffsetRequest{Topic: "orders", Offset: 1})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = rootClient.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing", Topic: "orders", Partition: 3})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = nobodyClient.CommitOffset(ctx, &api.CommitOffsetRequest{Group: "billing", Topic: "orders", Partition: 1, Offset: 1})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testConsumerGroup(t *testing.T, rootClient, nobodyClient api.LogClient, config *Config) {
+	ctx := context.Background()
+	first, err := rootClient.JoinGroup(ctx, &api.JoinGroupRequest{Group: "billing", Topics: []string{"orders"}, Strategy: "range"})
+	require.NoError(t, err)
+	second, err := rootClient.JoinGroup(ctx, &api.JoinGroupRequest{Group: "billing", Topics: []string{"orders"}, Strategy: "range"})
+	require.NoError(t, err)
+	require.NotEqual(t, first.MemberId, second.MemberId)
+
+	// Only subjects that may consume the group's topics can act as its members.
+	_, err = nobodyClient.SyncGroup(ctx, &api.SyncGroupRequest{Group: "billing", MemberId: first.MemberId})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyClient.Heartbeat(ctx, &api.HeartbeatRequest{Group: "billing", MemberId: first.MemberId, Generation: first.Generation})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = nobodyClient.LeaveGroup(ctx, &api.LeaveGroupRequest{Group: "billing", MemberId: first.MemberId})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// The first member's generation is stale once the second joins, so it can't commit until it syncs.
+	_, err = rootClient.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group: "billing", Topic: "orders", Partition: 1, Offset: 1, MemberId: first.MemberId, Generation: first.Generation,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = rootClient.CommitOffset(ctx, &api.CommitOffsetRequest{
+		Group: "billing", Topic: "orders", Partition: 1, Offset: 1, MemberId: second.MemberId, Generation: second.Generation,
+	})
+	require.NoError(t, err)
+
+	// The first member finds out about the second joining from its heartbeat.
+	heartbeat, err := rootClient.Heartbeat(ctx, &api.HeartbeatRequest{Group: "billing", MemberId: first.MemberId, Generation: first.Generation})
+	require.NoError(t, err)
+	require.True(t, heartbeat.Rebalance)
+	require.Equal(t, second.Generation, heartbeat.Generation)
+
+	var partitions []uint32
+	for _, memberID := range []string{first.MemberId, second.MemberId} {
+		sync, err := rootClient.SyncGroup(ctx, &api.SyncGroupRequest{Group: "billing", MemberId: memberID})
+		require.NoError(t, err)
+		require.Equal(t, second.Generation, sync.Generation)
+		require.Len(t, sync.Assignment, 1)
+		require.Equal(t, "orders", sync.Assignment[0].Topic)
+		partitions = append(partitions, sync.Assignment[0].Partitions...)
+	}
+	require.ElementsMatch(t, []uint32{0, 1, 2}, partitions)
+
+	_, err = rootClient.LeaveGroup(ctx, &api.LeaveGroupRequest{Group: "billing", MemberId: second.MemberId})
+	require.NoError(t, err)
+	sync, err := rootClient.SyncGroup(ctx, &api.SyncGroupRequest{Group: "billing", MemberId: first.MemberId})
+	require.NoError(t, err)
+	require.Equal(t, []uint32{0, 1, 2}, sync.Assignment[0].Partitions)
+
+	_, err = rootClient.Heartbeat(ctx, &api.HeartbeatRequest{Group: "billing", MemberId: second.MemberId})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = nobodyClient.JoinGroup(ctx, &api.JoinGroupRequest{Group: "billing", Topics: []string{"orders"}, Strategy: "range"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
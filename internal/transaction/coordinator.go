@@ -0,0 +1,235 @@
+package transaction
+
+import (
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/**
+ * Coordinator tracks the open transactions and the partitions each one produced to, and ends them by appending a commit or abort marker to each of those partitions.
+ * Read committed consumers skip a transaction's records until its marker, and skip them for good if it's an abort marker.
+ * Transactions that go without a produce for longer than the timeout are aborted, so an abandoned transaction doesn't hold up consumers forever.
+ */
+type Coordinator struct {
+	Config
+
+	mu           sync.Mutex
+	transactions map[uint64]*transaction
+	logger       *zap.Logger
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+type Config struct {
+	// Timeout is how long a transaction can go without a produce before it's aborted. It defaults to a minute.
+	Timeout time.Duration
+	// WriteMarker appends the marker to a partition of the topic, the default topic is named "".
+	WriteMarker func(topic string, partition uint32, marker *api.Record) error
+}
+
+// Partition is a partition of a topic that a transaction produced to.
+type Partition struct {
+	Topic     string
+	Partition uint32
+}
+
+type transaction struct {
+	// owner is the subject that began the transaction, only they can produce in it and end it.
+	owner      string
+	lastActive time.Time
+
+	// mu is held while a record is appended in the transaction or its markers are written, so no record lands after a marker.
+	mu         sync.Mutex
+	partitions map[Partition]struct{}
+	// ending is the marker the transaction is being ended with. It's kept while markers are still to be written, so a retry finishes it the same way.
+	ending api.ControlType
+}
+
+func NewCoordinator(config Config) *Coordinator {
+	if config.Timeout == 0 {
+		config.Timeout = time.Minute
+	}
+	c := &Coordinator{
+		Config:       config,
+		transactions: make(map[uint64]*transaction),
+		logger:       zap.L().Named("transactions"),
+		closed:       make(chan struct{}),
+	}
+	go c.expireTransactions()
+	return c
+}
+
+// Begin starts a transaction for the owner and returns its ID.
+func (c *Coordinator) Begin(owner string) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// IDs are random, so they don't repeat across restarts and can't be guessed.
+	id := rand.Uint64()
+	for _, ok := c.transactions[id]; id == 0 || ok; _, ok = c.transactions[id] {
+		id = rand.Uint64()
+	}
+	c.transactions[id] = &transaction{
+		owner:      owner,
+		lastActive: time.Now(),
+		partitions: make(map[Partition]struct{}),
+	}
+	return id, nil
+}
+
+// Recover adds a transaction found open in the partitions when the server started, so it can still be ended and times out if it isn't.
+// We don't know who began it, so anyone who knows its ID can end it.
+func (c *Coordinator) Recover(id uint64, partitions ...Partition) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.transactions[id]
+	if !ok {
+		t = &transaction{lastActive: time.Now(), partitions: make(map[Partition]struct{})}
+		c.transactions[id] = t
+	}
+	for _, p := range partitions {
+		t.partitions[p] = struct{}{}
+	}
+}
+
+// Produce runs write to append a record produced in the transaction to the partition. Ending the transaction waits for the appends in progress.
+func (c *Coordinator) Produce(id uint64, owner, topic string, partition uint32, write func() error) error {
+	c.mu.Lock()
+	t, err := c.transaction(id, owner)
+	if err == nil {
+		t.lastActive = time.Now()
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ending != api.ControlType_CONTROL_NONE {
+		return status.Errorf(codes.FailedPrecondition, "transaction %d is being ended", id)
+	}
+	t.partitions[Partition{Topic: topic, Partition: partition}] = struct{}{}
+	return write()
+}
+
+// Commit makes the transaction's records visible to read committed consumers.
+// If some of the markers couldn't be written it returns an error, and the commit can be retried to write the rest.
+func (c *Coordinator) Commit(id uint64, owner string) error {
+	return c.end(id, owner, api.ControlType_CONTROL_COMMIT)
+}
+
+// Abort discards the transaction's records for read committed consumers. Like Commit, it can be retried if it fails.
+func (c *Coordinator) Abort(id uint64, owner string) error {
+	return c.end(id, owner, api.ControlType_CONTROL_ABORT)
+}
+
+// transaction returns the open transaction, if the owner began it. The caller must hold the lock.
+func (c *Coordinator) transaction(id uint64, owner string) (*transaction, error) {
+	t, ok := c.transactions[id]
+	// We don't tell other subjects the transaction exists.
+	if !ok || (t.owner != "" && t.owner != owner) {
+		return nil, api.ErrUnknownTransaction{ID: id}
+	}
+	return t, nil
+}
+
+func (c *Coordinator) end(id uint64, owner string, control api.ControlType) error {
+	c.mu.Lock()
+	t, err := c.transaction(id, owner)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.finish(id, t, control)
+}
+
+// finish writes the marker to every partition the transaction produced to, and forgets the transaction once they're all written.
+func (c *Coordinator) finish(id uint64, t *transaction, control api.ControlType) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ending != api.ControlType_CONTROL_NONE && t.ending != control {
+		return status.Errorf(codes.FailedPrecondition, "transaction %d is already being ended with %s", id, t.ending)
+	}
+	t.ending = control
+	partitions := make([]Partition, 0, len(t.partitions))
+	for p := range t.partitions {
+		partitions = append(partitions, p)
+	}
+	sort.Slice(partitions, func(i, j int) bool {
+		if partitions[i].Topic != partitions[j].Topic {
+			return partitions[i].Topic < partitions[j].Topic
+		}
+		return partitions[i].Partition < partitions[j].Partition
+	})
+	var err error
+	for _, p := range partitions {
+		werr := c.WriteMarker(p.Topic, p.Partition, &api.Record{TransactionId: id, Control: control})
+		// A partition that isn't in the transaction any more already has its marker, from an earlier attempt.
+		if _, ok := werr.(api.ErrUnknownTransaction); werr != nil && !ok {
+			if err == nil {
+				err = werr
+			}
+			continue
+		}
+		delete(t.partitions, p)
+	}
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	delete(c.transactions, id)
+	c.mu.Unlock()
+	return nil
+}
+
+// expireTransactions aborts the transactions that have gone without a produce for longer than the timeout.
+// Transactions that were being committed are committed instead, as their commit has already been partly written.
+func (c *Coordinator) expireTransactions() {
+	ticker := time.NewTicker(c.Timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case now := <-ticker.C:
+			expired := make(map[uint64]*transaction)
+			c.mu.Lock()
+			for id, t := range c.transactions {
+				if now.Sub(t.lastActive) > c.Timeout {
+					expired[id] = t
+				}
+			}
+			c.mu.Unlock()
+			for id, t := range expired {
+				t.mu.Lock()
+				control := t.ending
+				t.mu.Unlock()
+				if control == api.ControlType_CONTROL_NONE {
+					control = api.ControlType_CONTROL_ABORT
+				}
+				if err := c.finish(id, t, control); err != nil {
+					// If we can't write the markers, e.g. because this server isn't the leader, we give up on the transaction. It's recovered again when the server restarts.
+					c.logger.Error("failed to end expired transaction", zap.Uint64("transaction", id), zap.Error(err))
+					c.mu.Lock()
+					delete(c.transactions, id)
+					c.mu.Unlock()
+				}
+			}
+		}
+	}
+}
+
+// Close stops expiring transactions.
+func (c *Coordinator) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
@@ -0,0 +1,138 @@
+package transaction
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoordinator(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, c *Coordinator, m *markers){
+		"commit writes markers to each partition": testCommit,
+		"abort writes abort markers":              testAbort,
+		"only the owner can use a transaction":    testOwner,
+		"failed commits can be retried":           testRetryCommit,
+		"expired transactions are aborted":        testExpiredTransactions,
+		"recovered transactions can be ended":     testRecover,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			m := &markers{written: make(map[Partition][]*api.Record), fail: make(map[Partition]bool)}
+			c := NewCoordinator(Config{
+				Timeout:     100 * time.Millisecond,
+				WriteMarker: m.write,
+			})
+			defer c.Close()
+			fn(t, c, m)
+		})
+	}
+}
+
+// markers is a fake set of partitions that records the markers written to them.
+type markers struct {
+	mu      sync.Mutex
+	written map[Partition][]*api.Record
+	// fail makes writing markers to the partition fail.
+	fail map[Partition]bool
+}
+
+func (m *markers) write(topic string, partition uint32, marker *api.Record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := Partition{Topic: topic, Partition: partition}
+	if m.fail[p] {
+		return errors.New("not the leader")
+	}
+	m.written[p] = append(m.written[p], marker)
+	return nil
+}
+
+func (m *markers) get(p Partition) []*api.Record {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.written[p]
+}
+
+func produce(t *testing.T, c *Coordinator, id uint64, owner string, partitions ...Partition) {
+	t.Helper()
+	for _, p := range partitions {
+		require.NoError(t, c.Produce(id, owner, p.Topic, p.Partition, func() error { return nil }))
+	}
+}
+
+func testCommit(t *testing.T, c *Coordinator, m *markers) {
+	id, err := c.Begin("alice")
+	require.NoError(t, err)
+	orders, payments := Partition{Topic: "orders", Partition: 1}, Partition{Topic: "payments"}
+	produce(t, c, id, "alice", orders, payments, orders)
+	require.NoError(t, c.Commit(id, "alice"))
+
+	for _, p := range []Partition{orders, payments} {
+		require.Equal(t, []*api.Record{{TransactionId: id, Control: api.ControlType_CONTROL_COMMIT}}, m.get(p))
+	}
+	// The transaction is over, so it can't be produced to or ended again.
+	require.Equal(t, api.ErrUnknownTransaction{ID: id}, c.Produce(id, "alice", "orders", 1, func() error { return nil }))
+	require.Equal(t, api.ErrUnknownTransaction{ID: id}, c.Commit(id, "alice"))
+}
+
+func testAbort(t *testing.T, c *Coordinator, m *markers) {
+	id, err := c.Begin("alice")
+	require.NoError(t, err)
+	p := Partition{Topic: "orders"}
+	produce(t, c, id, "alice", p)
+	require.NoError(t, c.Abort(id, "alice"))
+	require.Equal(t, []*api.Record{{TransactionId: id, Control: api.ControlType_CONTROL_ABORT}}, m.get(p))
+}
+
+func testOwner(t *testing.T, c *Coordinator, m *markers) {
+	id, err := c.Begin("alice")
+	require.NoError(t, err)
+	require.Equal(t, api.ErrUnknownTransaction{ID: id}, c.Produce(id, "bob", "orders", 0, func() error { return nil }))
+	require.Equal(t, api.ErrUnknownTransaction{ID: id}, c.Commit(id, "bob"))
+	require.NoError(t, c.Commit(id, "alice"))
+}
+
+func testRetryCommit(t *testing.T, c *Coordinator, m *markers) {
+	id, err := c.Begin("alice")
+	require.NoError(t, err)
+	orders, payments := Partition{Topic: "orders"}, Partition{Topic: "payments"}
+	produce(t, c, id, "alice", orders, payments)
+
+	m.mu.Lock()
+	m.fail[payments] = true
+	m.mu.Unlock()
+	require.Error(t, c.Commit(id, "alice"))
+	// The commit is partly written, so the transaction can't be aborted or produced to any more.
+	require.Error(t, c.Abort(id, "alice"))
+	require.Error(t, c.Produce(id, "alice", "orders", 0, func() error { return nil }))
+
+	m.mu.Lock()
+	m.fail[payments] = false
+	m.mu.Unlock()
+	require.NoError(t, c.Commit(id, "alice"))
+	// Each partition gets its marker once.
+	require.Len(t, m.get(orders), 1)
+	require.Len(t, m.get(payments), 1)
+}
+
+func testExpiredTransactions(t *testing.T, c *Coordinator, m *markers) {
+	id, err := c.Begin("alice")
+	require.NoError(t, err)
+	p := Partition{Topic: "orders"}
+	produce(t, c, id, "alice", p)
+	require.Eventually(t, func() bool {
+		return len(m.get(p)) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, api.ControlType_CONTROL_ABORT, m.get(p)[0].Control)
+	require.Equal(t, api.ErrUnknownTransaction{ID: id}, c.Commit(id, "alice"))
+}
+
+func testRecover(t *testing.T, c *Coordinator, m *markers) {
+	p := Partition{Topic: "orders", Partition: 2}
+	c.Recover(7, p)
+	require.NoError(t, c.Commit(7, "bob"))
+	require.Equal(t, []*api.Record{{TransactionId: 7, Control: api.ControlType_CONTROL_COMMIT}}, m.get(p))
+}
@@ -0,0 +1,120 @@
+package loadbalance
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// leaderOnlyKey marks a call's context when it has to go to the leader even though it only reads.
+type leaderOnlyKey struct{}
+
+// leaderOnly reports whether the call has to go to the leader.
+func leaderOnly(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	only, _ := ctx.Value(leaderOnlyKey{}).(bool)
+	return only
+}
+
+// topicRequest is implemented by the requests that can name a topic.
+type topicRequest interface {
+	GetTopic() string
+}
+
+// needsLeader reports whether the request reads a named topic. Named topics, their partitions, and the consumer groups'
+// offsets are only stored on the leader, so only the default topic can be read from the followers.
+func needsLeader(req interface{}) bool {
+	r, ok := req.(topicRequest)
+	return ok && r.GetTopic() != ""
+}
+
+/**
+ * DialOptions returns the options clients of the "proglog" scheme dial with. The picker only sees a call's method, so these add
+ * interceptors that tell it about consumes of named topics, which it then sends to the leader instead of the followers.
+ */
+func DialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(unaryInterceptor),
+		grpc.WithChainStreamInterceptor(streamInterceptor),
+	}
+}
+
+func unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if isConsume(method) && needsLeader(req) {
+		ctx = context.WithValue(ctx, leaderOnlyKey{}, true)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if !isConsume(method) || desc.ClientStreams {
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	// The server is picked when the stream is opened, before the request is sent, so we hold off opening it until we've seen the request.
+	return &lazyStream{ctx: ctx, open: func(ctx context.Context) (grpc.ClientStream, error) {
+		return streamer(ctx, desc, cc, method, opts...)
+	}}, nil
+}
+
+var errStreamNotOpen = errors.New("stream is not open until its request is sent")
+
+// lazyStream is a server stream that's only opened once its request is sent.
+type lazyStream struct {
+	ctx    context.Context
+	open   func(ctx context.Context) (grpc.ClientStream, error)
+	stream grpc.ClientStream
+}
+
+func (s *lazyStream) SendMsg(m interface{}) error {
+	if s.stream == nil {
+		ctx := s.ctx
+		if needsLeader(m) {
+			ctx = context.WithValue(ctx, leaderOnlyKey{}, true)
+		}
+		stream, err := s.open(ctx)
+		if err != nil {
+			return err
+		}
+		s.stream = stream
+	}
+	return s.stream.SendMsg(m)
+}
+
+func (s *lazyStream) RecvMsg(m interface{}) error {
+	if s.stream == nil {
+		return errStreamNotOpen
+	}
+	return s.stream.RecvMsg(m)
+}
+
+func (s *lazyStream) CloseSend() error {
+	if s.stream == nil {
+		return errStreamNotOpen
+	}
+	return s.stream.CloseSend()
+}
+
+func (s *lazyStream) Header() (metadata.MD, error) {
+	if s.stream == nil {
+		return nil, errStreamNotOpen
+	}
+	return s.stream.Header()
+}
+
+func (s *lazyStream) Trailer() metadata.MD {
+	if s.stream == nil {
+		return nil
+	}
+	return s.stream.Trailer()
+}
+
+func (s *lazyStream) Context() context.Context {
+	if s.stream == nil {
+		return s.ctx
+	}
+	return s.stream.Context()
+}
@@ -0,0 +1,74 @@
+package loadbalance
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+var _ base.PickerBuilder = (*PickerBuilder)(nil)
+
+// PickerBuilder builds a new Picker whenever the set of ready servers changes.
+type PickerBuilder struct{}
+
+func (b *PickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	p := &Picker{}
+	for sc, scInfo := range buildInfo.ReadySCs {
+		isLeader, _ := scInfo.Address.Attributes.Value("is_leader").(bool)
+		if isLeader {
+			p.leader = sc
+			continue
+		}
+		p.followers = append(p.followers, sc)
+	}
+	return p
+}
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(Name, &PickerBuilder{}, base.Config{}))
+}
+
+var _ balancer.Picker = (*Picker)(nil)
+
+/**
+ * Picker sends every call to the leader, except consumes of the default topic which are round-robined across the followers.
+ * Named topics are only stored on the leader, so their consumes go to the leader too. Clients dial with DialOptions to tell the picker which consumes those are.
+ * If there are no followers, consumes go to the leader as well.
+ */
+type Picker struct {
+	mu        sync.RWMutex
+	leader    balancer.SubConn
+	followers []balancer.SubConn
+	current   uint64
+}
+
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var result balancer.PickResult
+	if isConsume(info.FullMethodName) && !leaderOnly(info.Ctx) && len(p.followers) > 0 {
+		result.SubConn = p.nextFollower()
+	} else {
+		result.SubConn = p.leader
+	}
+	if result.SubConn == nil {
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	return result, nil
+}
+
+func (p *Picker) nextFollower() balancer.SubConn {
+	cur := atomic.AddUint64(&p.current, uint64(1))
+	len := uint64(len(p.followers))
+	idx := int(cur % len)
+	return p.followers[idx]
+}
+
+// isConsume reports whether the method only reads from the log, e.g. "/log.v1.Log/Consume".
+func isConsume(fullMethodName string) bool {
+	method := fullMethodName[strings.LastIndex(fullMethodName, "/")+1:]
+	return strings.HasPrefix(method, "Consume")
+}
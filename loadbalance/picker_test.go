@@ -0,0 +1,128 @@
+package loadbalance
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestPickerNoSubConnAvailable(t *testing.T) {
+	picker := (&PickerBuilder{}).Build(base.PickerBuildInfo{})
+	for _, method := range []string{
+		"/log.v1.Log/Produce",
+		"/log.v1.Log/Consume",
+	} {
+		info := balancer.PickInfo{
+			FullMethodName: method,
+		}
+		result, err := picker.Pick(info)
+		require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+		require.Nil(t, result.SubConn)
+	}
+}
+
+func TestPickerProducesToLeader(t *testing.T) {
+	picker, subConns := setupPicker(2)
+	for _, method := range []string{
+		"/log.v1.Log/Produce",
+		"/log.v1.Log/ProduceStream",
+		"/log.v1.Log/GetServers",
+		// Offsets and groups are only stored on the leader.
+		"/log.v1.Log/CommitOffset",
+		"/log.v1.Log/FetchOffset",
+		"/log.v1.Log/JoinGroup",
+		"/log.v1.Log/Heartbeat",
+	} {
+		for i := 0; i < 5; i++ {
+			gotPick, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+			require.NoError(t, err)
+			require.Equal(t, subConns[0], gotPick.SubConn)
+		}
+	}
+}
+
+func TestPickerConsumesFromFollowers(t *testing.T) {
+	picker, subConns := setupPicker(2)
+	for _, method := range []string{
+		"/log.v1.Log/Consume",
+		"/log.v1.Log/ConsumeStream",
+	} {
+		// Consumes are spread across both followers in turn.
+		seen := map[balancer.SubConn]int{}
+		for i := 0; i < 4; i++ {
+			gotPick, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+			require.NoError(t, err)
+			require.NotEqual(t, subConns[0], gotPick.SubConn)
+			seen[gotPick.SubConn]++
+		}
+		require.Equal(t, 2, seen[subConns[1]])
+		require.Equal(t, 2, seen[subConns[2]])
+	}
+}
+
+func TestPickerConsumesTopicsFromLeader(t *testing.T) {
+	picker, subConns := setupPicker(2)
+	var picked context.Context
+	// The interceptor marks consumes of named topics, which only the leader has.
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		picked = ctx
+		return nil
+	}
+	for req, leader := range map[*api.ConsumeRequest]bool{
+		{Offset: 1}:                  false,
+		{Offset: 1, Topic: "orders"}: true,
+	} {
+		require.NoError(t, unaryInterceptor(context.Background(), "/log.v1.Log/Consume", req, nil, nil, invoker))
+		for i := 0; i < 4; i++ {
+			gotPick, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/Consume", Ctx: picked})
+			require.NoError(t, err)
+			require.Equal(t, leader, gotPick.SubConn == subConns[0])
+		}
+	}
+}
+
+func TestPickerConsumesFromLeaderWithoutFollowers(t *testing.T) {
+	picker, subConns := setupPicker(0)
+	gotPick, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/Consume"})
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], gotPick.SubConn)
+}
+
+// setupPicker builds a picker with a leader, which is always the first sub conn, and the given number of followers.
+func setupPicker(followers int) (balancer.Picker, []*subConn) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	for i := 0; i <= followers; i++ {
+		sc := &subConn{}
+		addr := resolver.Address{
+			Attributes: attributes.New("is_leader", i == 0),
+		}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	picker := (&PickerBuilder{}).Build(buildInfo)
+	return picker, subConns
+}
+
+// subConn implements balancer.SubConn.
+type subConn struct {
+	balancer.SubConn
+	addrs []resolver.Address
+}
+
+func (s *subConn) UpdateAddresses(addrs []resolver.Address) {
+	s.addrs = addrs
+}
+
+func (s *subConn) Connect() {}
@@ -0,0 +1,121 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// Name is both the resolver's scheme and the balancer's name, clients dial "proglog:///<address of any server>" with DialOptions.
+const Name = "proglog"
+
+var _ resolver.Builder = (*Builder)(nil)
+
+// Builder builds a Resolver for every client connection using the proglog scheme.
+type Builder struct{}
+
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	r := &Resolver{
+		clientConn: cc,
+		logger:     zap.L().Named("resolver"),
+		timeout:    resolveTimeout,
+	}
+	var dialOpts []grpc.DialOption
+	if opts.DialCreds != nil {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(opts.DialCreds))
+	}
+	// Tell gRPC to balance the connection with our picker.
+	r.serviceConfig = r.clientConn.ParseServiceConfig(
+		fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
+	)
+	var err error
+	r.resolverConn, err = grpc.NewClient(target.Endpoint(), dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	return r, nil
+}
+
+func (b *Builder) Scheme() string {
+	return Name
+}
+
+func init() {
+	resolver.Register(&Builder{})
+}
+
+var _ resolver.Resolver = (*Resolver)(nil)
+
+// resolveTimeout bounds how long resolving waits for the server, so an unresponsive one doesn't hold up gRPC.
+const resolveTimeout = 5 * time.Second
+
+/**
+ * Resolver discovers the servers in a proglog cluster by calling GetServers on the address it was given.
+ * Each address is tagged with whether the server is the leader, so the picker can route writes to it.
+ */
+type Resolver struct {
+	clientConn    resolver.ClientConn
+	resolverConn  *grpc.ClientConn
+	serviceConfig *serviceconfig.ParseResult
+	logger        *zap.Logger
+	timeout       time.Duration
+
+	// mu guards updating the client connection. started numbers the resolutions and applied is the latest one whose result was used,
+	// so a slow resolution that finishes after a newer one doesn't overwrite its servers.
+	mu      sync.Mutex
+	started uint64
+	applied uint64
+}
+
+// ResolveNow asks the server for the cluster's servers. The call is made without holding the lock, so concurrent resolutions don't queue up behind a slow one.
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	r.started++
+	resolution := r.started
+	r.mu.Unlock()
+
+	client := api.NewLogClient(r.resolverConn)
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	res, err := client.GetServers(ctx, &api.GetServersRequest{})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if resolution < r.applied {
+		return
+	}
+	r.applied = resolution
+	if err != nil {
+		r.logger.Error("failed to resolve servers", zap.Error(err))
+		r.clientConn.ReportError(err)
+		return
+	}
+	var addrs []resolver.Address
+	for _, server := range res.Servers {
+		addrs = append(addrs, resolver.Address{
+			Addr:       server.RpcAddr,
+			Attributes: attributes.New("is_leader", server.IsLeader),
+		})
+	}
+	if err = r.clientConn.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	}); err != nil {
+		r.logger.Error("failed to update state", zap.Error(err))
+	}
+}
+
+func (r *Resolver) Close() {
+	if err := r.resolverConn.Close(); err != nil {
+		r.logger.Error("failed to close conn", zap.Error(err))
+	}
+}
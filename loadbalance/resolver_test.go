@@ -0,0 +1,112 @@
+package loadbalance
+
+import (
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "github.com/MartinMinkov/proglog/api/v1"
+	"github.com/MartinMinkov/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+)
+
+func TestResolver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	getServerer := &getServers{release: make(chan struct{})}
+	srv, err := server.NewGRPCServer(&server.Config{
+		GetServerer: getServerer,
+	})
+	require.NoError(t, err)
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	defer srv.Stop()
+	// Stopping the server waits for the blocked call.
+	defer close(getServerer.release)
+
+	conn := &clientConn{}
+	opts := resolver.BuildOptions{
+		DialCreds: insecure.NewCredentials(),
+	}
+	target, err := url.Parse(Name + ":///" + l.Addr().String())
+	require.NoError(t, err)
+	r, err := (&Builder{}).Build(resolver.Target{URL: *target}, conn, opts)
+	require.NoError(t, err)
+	defer r.Close()
+
+	wantState := resolver.State{
+		Addresses: []resolver.Address{{
+			Addr:       "localhost:9001",
+			Attributes: attributes.New("is_leader", true),
+		}, {
+			Addr:       "localhost:9002",
+			Attributes: attributes.New("is_leader", false),
+		}},
+	}
+	require.Equal(t, wantState, conn.state)
+
+	// Resolving again picks up any changes to the cluster.
+	conn.state.Addresses = nil
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	require.Equal(t, wantState, conn.state)
+
+	// A server that doesn't answer gives up after the timeout and reports the error.
+	r.(*Resolver).timeout = 100 * time.Millisecond
+	getServerer.block.Store(true)
+	start := time.Now()
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, codes.DeadlineExceeded, status.Code(conn.err))
+}
+
+// getServers returns a leader and a follower, or blocks until released while block is set.
+type getServers struct {
+	block   atomic.Bool
+	release chan struct{}
+}
+
+func (s *getServers) GetServers() ([]*api.Server, error) {
+	if s.block.Load() {
+		<-s.release
+	}
+	return []*api.Server{{
+		Id:       "leader",
+		RpcAddr:  "localhost:9001",
+		IsLeader: true,
+	}, {
+		Id:      "follower",
+		RpcAddr: "localhost:9002",
+	}}, nil
+}
+
+// clientConn implements resolver.ClientConn and records the state the resolver sends it.
+type clientConn struct {
+	resolver.ClientConn
+	state resolver.State
+	err   error
+}
+
+func (c *clientConn) UpdateState(state resolver.State) error {
+	c.state = state
+	return nil
+}
+
+func (c *clientConn) ReportError(err error) {
+	c.err = err
+}
+
+func (c *clientConn) NewAddress(addrs []resolver.Address) {}
+
+func (c *clientConn) ParseServiceConfig(config string) *serviceconfig.ParseResult {
+	return nil
+}